@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/valyala/fasthttp"
+)
+
+type referrerBlacklist struct {
+	hosts *hostTrie
+
+	// where the hosts came from: "downloaded", "cached" (on postgres) or
+	// "embedded" (fallbackBlacklist), and when they were downloaded.
+	source    string
+	fetchedAt time.Time
+
+	// per-site rules, by domain.
+	// hosts on `allow` are never blocked for that site (even if they are on the
+	// global lists), hosts on `block` always are.
+	allow map[string]*hostTrie
+	block map[string]*hostTrie
+}
+
+// blocks matches the host and all its parent domains against the lists.
+func (b *referrerBlacklist) blocks(domain, host string) bool {
+	if allow, ok := b.allow[domain]; ok && allow.matches(host) {
+		return false
+	}
+	if block, ok := b.block[domain]; ok && block.matches(host) {
+		return true
+	}
+	return b.hosts.matches(host)
+}
+
+// holds a *referrerBlacklist, swapped atomically on every refresh.
+var blacklist atomic.Value
+
+func currentBlacklist() *referrerBlacklist {
+	if b, ok := blacklist.Load().(*referrerBlacklist); ok {
+		return b
+	}
+	return &referrerBlacklist{hosts: newHostTrie()}
+}
+
+// initReferrerBlacklist loads the blacklist from the postgres cache, falling
+// back to the embedded list when there's nothing cached yet.
+// returns the time in which the cached list was fetched (zero if none).
+func initReferrerBlacklist() (fetchedAt time.Time) {
+	var cached struct {
+		Hosts     types.JSONText `db:"hosts"`
+		FetchedAt time.Time      `db:"fetched_at"`
+	}
+
+	var hosts []string
+	err := pg.Get(&cached, `SELECT hosts, fetched_at FROM blacklist_cache`)
+	if err == nil {
+		err = json.Unmarshal(cached.Hosts, &hosts)
+	}
+	source := "cached"
+	if err != nil || len(hosts) == 0 {
+		log.Warn().Err(err).Msg("no cached referrer blacklist, using the embedded one.")
+		hosts = fallbackBlacklist
+		source = "embedded"
+	} else {
+		fetchedAt = cached.FetchedAt
+	}
+
+	refmap := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		refmap[host] = true
+	}
+	swapReferrerBlacklist(refmap, source, fetchedAt)
+	loadReferrerRules()
+
+	return fetchedAt
+}
+
+// keepReferrerBlacklistFresh should run in its own goroutine.
+// it downloads the remote lists every `interval`, or sooner if the cached
+// list is already older than that.
+func keepReferrerBlacklistFresh(fetchedAt time.Time, interval time.Duration) {
+	wait := interval - time.Since(fetchedAt)
+	if wait < 0 {
+		wait = 0
+	}
+
+	for {
+		time.Sleep(wait)
+		wait = interval
+
+		refmap := fetchReferrerBlacklist()
+		if len(refmap) == 0 {
+			log.Warn().Msg("failed to download referrer blacklists, will try again later.")
+			wait = time.Minute * 10
+			continue
+		}
+
+		hosts := make([]string, 0, len(refmap))
+		for host := range refmap {
+			hosts = append(hosts, host)
+		}
+		jsonhosts, _ := json.Marshal(hosts)
+		if _, err := pg.Exec(`
+INSERT INTO blacklist_cache (hosts, fetched_at) VALUES ($1, now())
+ON CONFLICT (singleton) DO UPDATE SET hosts = $1, fetched_at = now()
+        `, types.JSONText(jsonhosts)); err != nil {
+			log.Warn().Err(err).Msg("failed to cache referrer blacklist on postgres.")
+		}
+
+		swapReferrerBlacklist(refmap, "downloaded", time.Now())
+	}
+}
+
+// both the downloaded hosts and the per-site rules are refreshed on their own,
+// each replacing its half of the blacklist, so they take turns.
+var blacklistSwap sync.Mutex
+
+// swapReferrerBlacklist replaces the current blacklist with one made of the
+// given hosts and the per-site rules already loaded.
+func swapReferrerBlacklist(hosts map[string]bool, source string, fetchedAt time.Time) {
+	trie := newHostTrie()
+	var refused int
+	for host := range hosts {
+		if !trie.add(host) {
+			refused++
+		}
+	}
+	if refused > 0 {
+		log.Warn().Int("refused", refused).Str("source", source).
+			Msg("ignored invalid hosts on the referrer blacklist.")
+	}
+
+	blacklistSwap.Lock()
+	defer blacklistSwap.Unlock()
+	current := currentBlacklist()
+	blacklist.Store(&referrerBlacklist{
+		hosts:     trie,
+		source:    source,
+		fetchedAt: fetchedAt,
+		allow:     current.allow,
+		block:     current.block,
+	})
+	log.Info().Int("hosts", len(hosts)).Str("source", source).
+		Msg("using new referrer blacklist.")
+}
+
+// loadReferrerRules reads the per-site rules from postgres and replaces the
+// ones in the current blacklist.
+func loadReferrerRules() {
+	var rules []struct {
+		Domain string `db:"domain"`
+		Host   string `db:"host"`
+		Allow  bool   `db:"allow"`
+	}
+	err := pg.Select(&rules, `SELECT domain, host, allow FROM referrer_rules`)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load per-site referrer rules.")
+		return
+	}
+
+	allow := make(map[string]*hostTrie)
+	block := make(map[string]*hostTrie)
+	for _, rule := range rules {
+		sitelist := block
+		if rule.Allow {
+			sitelist = allow
+		}
+		if _, ok := sitelist[rule.Domain]; !ok {
+			sitelist[rule.Domain] = newHostTrie()
+		}
+		if !sitelist[rule.Domain].add(rule.Host) {
+			log.Warn().Str("domain", rule.Domain).Str("host", rule.Host).
+				Msg("ignored invalid referrer rule.")
+		}
+	}
+
+	blacklistSwap.Lock()
+	defer blacklistSwap.Unlock()
+	current := currentBlacklist()
+	blacklist.Store(&referrerBlacklist{
+		hosts:     current.hosts,
+		source:    current.source,
+		fetchedAt: current.fetchedAt,
+		allow:     allow,
+		block:     block,
+	})
+	log.Debug().Int("rules", len(rules)).Msg("loaded per-site referrer rules.")
+}
+
+// keepReferrerRulesFresh should run in its own goroutine.
+func keepReferrerRulesFresh(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		loadReferrerRules()
+	}
+}
+
+func fetchReferrerBlacklist() map[string]bool {
+	refmap := make(map[string]bool)
+
+	lines := ""
+	client := &fasthttp.Client{Name: "Mozilla/5.0 (X11; Linux i686) AppleWebKit/537.36 (KHTML, like Gecko) Ubuntu Chromium/56.0.2924.76 Chrome/56.0.2924.76 Safari/537.36"}
+	for _, u := range []string{
+		"https://raw.githubusercontent.com/piwik/referrer-spam-blacklist/master/spammers.txt",
+		"https://raw.githubusercontent.com/ddofborg/analytics-ghost-spam-list/master/adwordsrobot.com-spam-list.txt",
+	} {
+		r := fasthttp.AcquireRequest()
+		r.SetRequestURI(u)
+
+		w := fasthttp.AcquireResponse()
+		err := client.DoTimeout(r, w, time.Second*25)
+		if err != nil {
+			continue
+		}
+
+		lines += string(w.Body())
+		lines += "\n"
+	}
+
+	for _, line := range strings.Split(lines, "\n") {
+		if host := strings.TrimSpace(line); host != "" {
+			refmap[host] = true
+		}
+	}
+
+	if doc, err := goquery.NewDocument("https://referrerspamblocker.com/blacklist"); err == nil {
+		doc.Find(".blacklist li").Each(func(i int, s *goquery.Selection) {
+			if host := strings.TrimSpace(s.Text()); host != "" {
+				refmap[host] = true
+			}
+		})
+	}
+
+	return refmap
+}
+
+// used when we're offline and have never managed to fetch the remote lists.
+var fallbackBlacklist = []string{
+	"100dollars-seo.com",
+	"4webmasters.org",
+	"7makemoneyonline.com",
+	"anticrawler.org",
+	"best-seo-offer.com",
+	"best-seo-solution.com",
+	"blackhatworth.com",
+	"buttons-for-website.com",
+	"buttons-for-your-website.com",
+	"buy-cheap-online.info",
+	"cenoval.ru",
+	"darodar.com",
+	"econom.co",
+	"event-tracking.com",
+	"floating-share-buttons.com",
+	"free-share-buttons.com",
+	"free-social-buttons.com",
+	"get-free-social-traffic.com",
+	"get-free-traffic-now.com",
+	"hulfingtonpost.com",
+	"humanorightswatch.org",
+	"ilovevitaly.co",
+	"ilovevitaly.com",
+	"ilovevitaly.ru",
+	"iskalko.ru",
+	"kambasoft.com",
+	"o-o-6-o-o.com",
+	"o-o-8-o-o.com",
+	"priceg.com",
+	"rank-checker.online",
+	"ranksonic.info",
+	"savetubevideo.com",
+	"screentoolkit.com",
+	"semalt.com",
+	"simple-share-buttons.com",
+	"social-buttons.com",
+	"success-seo.com",
+	"trafficmonetize.org",
+	"trafficmonetizer.org",
+	"videos-for-your-business.com",
+	"webmonetizer.net",
+	"website-analyzer.info",
+}
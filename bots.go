@@ -0,0 +1,108 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// substrings (lowercased) found in the User-Agent of known crawlers, headless
+// browsers and monitoring tools. most of these run javascript, so they will
+// happily call tc() on every page they visit.
+// crawlers named "something-bot" are caught by botWord instead.
+var botPatterns = []string{
+	"crawl",
+	"spider",
+	"slurp",
+	"scrape",
+	"archiver",
+	"facebookexternalhit",
+	"facebookcatalog",
+	"embedly",
+	"quora link preview",
+	"whatsapp",
+	"skypeuripreview",
+	"vkshare",
+	"outbrain",
+	"flipboardproxy",
+	"nuzzel",
+	"validator",
+	"lighthouse",
+	"pagespeed",
+	"pingdom",
+	"uptimerobot",
+	"statuscake",
+	"site24x7",
+	"newrelicpinger",
+	"gtmetrix",
+	"headlesschrome",
+	"phantomjs",
+	"slimerjs",
+	"puppeteer",
+	"playwright",
+	"selenium",
+	"webdriver",
+	"cypress",
+	"prerender",
+	"rendertron",
+	"python-requests",
+	"python-urllib",
+	"aiohttp",
+	"go-http-client",
+	"java/",
+	"okhttp",
+	"apache-httpclient",
+	"libwww-perl",
+	"curl/",
+	"wget/",
+	"httpie",
+	"node-fetch",
+	"axios/",
+	"scrapy",
+	"mediapartners-google",
+	"adsbot-google",
+	"google-read-aloud",
+	"google favicon",
+	"yandex.com/bots",
+	"baiduspider",
+	"bingpreview",
+	"semrush",
+	"ahrefs",
+}
+
+// a word ending in "bot", like "Googlebot/2.1", "DuckDuckBot-Https",
+// "Pinterestbot" or "(compatible; bot)".
+var botWord = regexp.MustCompile(`[a-z0-9]*bot\b`)
+
+// words that end in "bot" but are not robots, like phone brands.
+var notBots = map[string]bool{
+	"cubot": true,
+}
+
+// detectBot tells if the request that is calling track() looks like it comes
+// from a robot. the returned string is the reason, useful for logging.
+func detectBot(c *fasthttp.RequestCtx) (isBot bool, reason string) {
+	ua := strings.ToLower(string(c.UserAgent()))
+	if ua == "" {
+		return true, "missing user-agent"
+	}
+
+	for _, pattern := range botPatterns {
+		if strings.Contains(ua, pattern) {
+			return true, pattern
+		}
+	}
+	for _, word := range botWord.FindAllString(ua, -1) {
+		if !notBots[word] {
+			return true, word
+		}
+	}
+
+	// every real browser sends this on XMLHttpRequest calls.
+	if len(c.Request.Header.Peek("Accept-Language")) == 0 {
+		return true, "missing accept-language"
+	}
+
+	return false, ""
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// bucket takes a day (20060102) or a month (200601) and returns the name
+// of the bucket it falls in, according to the granularity asked:
+//   - day: 20060102
+//   - week: 20060102 (the day the week starts)
+//   - month: 200601
+//   - quarter: 2006Q1
+//   - year: 2006
+func (params Params) bucket(date string) string {
+	layout := DATEFORMAT
+	if len(date) == len(MONTHFORMAT) {
+		layout = MONTHFORMAT
+	}
+	t, err := time.Parse(layout, date)
+	if err != nil {
+		return date
+	}
+
+	switch params.Granularity {
+	case "week":
+		weekstart := time.Monday
+		if params.WeekStart != "" {
+			weekstart = weekdays[strings.ToLower(params.WeekStart)]
+		}
+		diff := (int(t.Weekday()) - int(weekstart) + 7) % 7
+		return t.AddDate(0, 0, -diff).Format(DATEFORMAT)
+	case "month":
+		return t.Format(MONTHFORMAT)
+	case "quarter":
+		return fmt.Sprintf("%dQ%d", t.Year(), (int(t.Month())-1)/3+1)
+	case "year":
+		return t.Format("2006")
+	default:
+		return date
+	}
+}
+
+// groupMonths merges months that fall in the same bucket (for the quarter
+// and year granularities).
+func groupMonths(params Params, months []Month) []Month {
+	if params.Granularity != "quarter" && params.Granularity != "year" {
+		return months
+	}
+
+	var grouped []Month
+	for _, month := range months {
+		name := params.bucket(month.Month)
+		if len(grouped) == 0 || grouped[len(grouped)-1].Month != name {
+			grouped = append(grouped, Month{Month: name, Compendium: *newCompendium()})
+		}
+		current := &grouped[len(grouped)-1]
+		current.Stats.add(month.Stats)
+		current.Compendium.join(month.Compendium)
+	}
+	return grouped
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBucket(t *testing.T) {
+	for _, test := range []struct {
+		granularity string
+		weekStart   string
+		date        string
+		expected    string
+	}{
+		{"", "", "20170101", "20170101"},
+		{"day", "", "20170101", "20170101"},
+
+		// 2017-01-01 is a sunday
+		{"week", "", "20170101", "20161226"},
+		{"week", "monday", "20170101", "20161226"},
+		{"week", "monday", "20170102", "20170102"},
+		{"week", "monday", "20161231", "20161226"},
+		{"week", "sunday", "20170101", "20170101"},
+		{"week", "Sunday", "20170102", "20170101"},
+		{"week", "sunday", "20161231", "20161225"},
+		{"week", "saturday", "20170101", "20161231"},
+		{"week", "monday", "20200101", "20191230"},
+		{"week", "sunday", "20200101", "20191229"},
+		{"week", "monday", "20160301", "20160229"},
+
+		{"month", "", "20170131", "201701"},
+		{"month", "", "201701", "201701"},
+		{"quarter", "", "20170331", "2017Q1"},
+		{"quarter", "", "20170401", "2017Q2"},
+		{"quarter", "", "201709", "2017Q3"},
+		{"quarter", "", "201712", "2017Q4"},
+		{"year", "", "20171231", "2017"},
+		{"year", "", "201801", "2018"},
+
+		{"month", "", "garbage", "garbage"},
+	} {
+		params := Params{Granularity: test.granularity, WeekStart: test.weekStart}
+		if bucket := params.bucket(test.date); bucket != test.expected {
+			t.Errorf("%s (week start %q) of %s = %s, expected %s",
+				test.granularity, test.weekStart, test.date, bucket, test.expected)
+		}
+	}
+}
+
+func TestGroupMonths(t *testing.T) {
+	var months []Month
+	for i, name := range []string{"201611", "201612", "201701", "201702", "201703", "201704"} {
+		month := Month{Month: name, Stats: Stats{NSessions: i + 1, Score: 10}, Compendium: *newCompendium()}
+		month.TopPages["/"] = i + 1
+		months = append(months, month)
+	}
+
+	for _, test := range []struct {
+		granularity string
+		names       []string
+		sessions    []int
+		pages       []int
+	}{
+		{"month", []string{"201611", "201612", "201701", "201702", "201703", "201704"},
+			[]int{1, 2, 3, 4, 5, 6}, []int{1, 2, 3, 4, 5, 6}},
+		{"quarter", []string{"2016Q4", "2017Q1", "2017Q2"}, []int{3, 12, 6}, []int{3, 12, 6}},
+		{"year", []string{"2016", "2017"}, []int{3, 18}, []int{3, 18}},
+	} {
+		grouped := groupMonths(Params{Granularity: test.granularity}, months)
+
+		var names []string
+		var sessions, pages []int
+		for _, month := range grouped {
+			names = append(names, month.Month)
+			sessions = append(sessions, month.NSessions)
+			pages = append(pages, month.TopPages["/"])
+		}
+		if !reflect.DeepEqual(names, test.names) ||
+			!reflect.DeepEqual(sessions, test.sessions) ||
+			!reflect.DeepEqual(pages, test.pages) {
+			t.Errorf("%s: got %v with %v sessions and %v pageviews of /, expected %v with %v and %v",
+				test.granularity, names, sessions, pages, test.names, test.sessions, test.pages)
+		}
+	}
+
+	// grouping doesn't change the months it was given
+	if months[0].NSessions != 1 || months[0].TopPages["/"] != 1 {
+		t.Errorf("groupMonths changed its input: %+v", months[0])
+	}
+}
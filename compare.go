@@ -0,0 +1,43 @@
+package main
+
+// Comparison is what we return about the preceding period when the query
+// asks for it. changes are percentages, null when there's nothing to compare
+// against (the previous value was zero).
+type Comparison struct {
+	Stats     Stats               `json:"stats"`  // totals for the preceding period
+	Change    map[string]*float64 `json:"change"` // same keys as Stats
+	Pages     map[string]*float64 `json:"p"`      // for each page in the current top pages
+	Referrers map[string]*float64 `json:"r"`      // for each referrer in the current top referrers
+}
+
+func compare(current, previous Stats, cc, pc *Compendium) *Comparison {
+	comparison := &Comparison{
+		Stats: previous,
+		Change: map[string]*float64{
+			"s": percentChange(current.NSessions, previous.NSessions),
+			"b": percentChange(current.NBounces, previous.NBounces),
+			"v": percentChange(current.NPageviews, previous.NPageviews),
+			"c": percentChange(current.Score, previous.Score),
+			"i": percentChange(current.NVisitors, previous.NVisitors),
+		},
+		Pages:     make(map[string]*float64, len(cc.TopPages)),
+		Referrers: make(map[string]*float64, len(cc.TopReferrers)),
+	}
+
+	for page, count := range cc.TopPages {
+		comparison.Pages[page] = percentChange(count, pc.TopPages[page])
+	}
+	for referrer, count := range cc.TopReferrers {
+		comparison.Referrers[referrer] = percentChange(count, pc.TopReferrers[referrer])
+	}
+
+	return comparison
+}
+
+func percentChange(current, previous int) *float64 {
+	if previous == 0 {
+		return nil
+	}
+	change := float64(current-previous) / float64(previous) * 100
+	return &change
+}
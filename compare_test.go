@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestPercentChange(t *testing.T) {
+	for _, test := range []struct {
+		current, previous int
+		expected          float64
+	}{
+		{150, 100, 50},
+		{50, 100, -50},
+		{0, 100, -100},
+		{100, 100, 0},
+		{3, 1, 200},
+	} {
+		change := percentChange(test.current, test.previous)
+		if change == nil || *change != test.expected {
+			t.Errorf("percentChange(%d, %d) = %v, expected %v", test.current, test.previous, change, test.expected)
+		}
+	}
+	if change := percentChange(10, 0); change != nil {
+		t.Errorf("percentChange(10, 0) = %v, expected nil", *change)
+	}
+	if change := percentChange(0, 0); change != nil {
+		t.Errorf("percentChange(0, 0) = %v, expected nil", *change)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	current := Stats{NSessions: 20, NBounces: 5, NPageviews: 40, Score: 60}
+	previous := Stats{NSessions: 10, NBounces: 10, NPageviews: 40, Score: 0}
+	cc := &Compendium{
+		TopPages:     map[string]int{"/": 10, "/new": 4},
+		TopReferrers: map[string]int{"t.co/": 3},
+	}
+	pc := &Compendium{
+		TopPages:     map[string]int{"/": 20, "/gone": 7},
+		TopReferrers: map[string]int{},
+	}
+
+	comparison := compare(current, previous, cc, pc)
+	if comparison.Stats != previous {
+		t.Errorf("comparison stats = %+v, expected the previous ones", comparison.Stats)
+	}
+
+	for key, expected := range map[string]float64{"s": 100, "b": -50, "v": 0} {
+		if change := comparison.Change[key]; change == nil || *change != expected {
+			t.Errorf("change of %s = %v, expected %v", key, change, expected)
+		}
+	}
+	for _, key := range []string{"c", "i"} {
+		if change, ok := comparison.Change[key]; !ok || change != nil {
+			t.Errorf("change of %s should be there and nil, as it was zero before", key)
+		}
+	}
+
+	if change := comparison.Pages["/"]; change == nil || *change != -50 {
+		t.Errorf("change of / = %v, expected -50", change)
+	}
+	if change, ok := comparison.Pages["/new"]; !ok || change != nil {
+		t.Error("a page only in the current period should have a nil change")
+	}
+	if _, ok := comparison.Pages["/gone"]; ok {
+		t.Error("pages only in the previous period shouldn't be compared")
+	}
+	if change, ok := comparison.Referrers["t.co/"]; !ok || change != nil {
+		t.Error("a referrer only in the current period should have a nil change")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import "strconv"
+
+// each day, for each domain, we keep in redis a set with the keys of all the
+// sessions and a hash with the totals (the same fields as Stats), updated on
+// every hit (see trackScript), so we don't have to go through all sessions to
+// know them.
+func makeIndexKey(code, day string) string { return "sessions:" + makeBaseKey(code, day) }
+func makeStatsKey(code, day string) string { return "stats:" + makeBaseKey(code, day) }
+
+// the ids of the visitors seen on the day (see visitorID()), so they can be
+// counted without reading the sessions too. only when COUNT_VISITORS is on.
+func makeVisitorsKey(code, day string) string { return "visitors:" + makeBaseKey(code, day) }
+
+// statsFromRedis reads the totals kept by trackScript.
+// `ok` is false when nothing was tracked on that day (or on days from before
+// we started keeping them).
+func statsFromRedis(domain, day string) (stats Stats, ok bool, err error) {
+	pipe := rds.Pipeline()
+	defer pipe.Close()
+	totals := pipe.HGetAll(makeStatsKey(domain, day))
+	visitors := pipe.SCard(makeVisitorsKey(domain, day))
+	if _, err = pipe.Exec(); err != nil {
+		return
+	}
+
+	fields := totals.Val()
+	if len(fields) == 0 {
+		return
+	}
+	stats.NSessions, _ = strconv.Atoi(fields["nsessions"])
+	stats.NBounces, _ = strconv.Atoi(fields["nbounces"])
+	stats.NPageviews, _ = strconv.Atoi(fields["npageviews"])
+	stats.Score, _ = strconv.Atoi(fields["score"])
+	stats.NVisitors = int(visitors.Val())
+	return stats, true, nil
+}
+
+type filteredKey struct{ domain, day, reason string }
+
+// countFiltered counts hits we refused to track, by reason. with background
+// ingestion the counts are added up and written by the ingester.
+func countFiltered(domain, day, reason string) {
+	metrics.hitsFiltered.inc(reason)
+
+	if ingestion != nil {
+		ingestion.countFiltered(domain, day, reason)
+		return
+	}
+	writeFilteredCounts(map[filteredKey]int64{{domain, day, reason}: 1})
+}
+
+func writeFilteredCounts(counts map[filteredKey]int64) {
+	pipe := rds.Pipeline()
+	defer pipe.Close()
+	for key, n := range counts {
+		pipe.HIncrBy(makeFilteredKey(key.domain, key.day), key.reason, n)
+		pipe.Expire(makeFilteredKey(key.domain, key.day), redisExpireInterval)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		log.Warn().Err(err).Int("counts", len(counts)).Msg("failed to count filtered hits")
+	}
+}
+
+// parseEvent reads an event as stored in the redis session lists.
+func parseEvent(event string) interface{} {
+	if points, err := strconv.Atoi(event); err == nil {
+		return points
+	}
+	return event
+}
@@ -0,0 +1,82 @@
+package main
+
+import "strings"
+
+// Filter restricts the sessions that are counted in a query.
+// empty fields match everything.
+type Filter struct {
+	ReferrerFilter string `json:"referrer_filter"` // part of the referrer, or a source name like "Google"
+	Page           string `json:"page"`            // sessions that visited this page
+	Country        string `json:"country"`
+	Device         string `json:"device"`
+	Campaign       string `json:"campaign"` // utm_campaign or utm_source
+	MinScore       int    `json:"min_score"`
+	MaxScore       int    `json:"max_score"`
+	Bot            bool   `json:"bot"` // sessions tagged as bots, see FILTER_BOTS
+
+	// match the sessions that don't match all the other fields instead,
+	// like "didn't visit /pricing".
+	Not bool `json:"not"`
+}
+
+// empty ignores `not`, as negating no conditions still matches everything.
+func (f Filter) empty() bool {
+	f.Not = false
+	return f == Filter{}
+}
+
+func (f Filter) matches(session Session) bool {
+	if f.empty() {
+		return true
+	}
+	return f.matchesAll(session) != f.Not
+}
+
+func (f Filter) matchesAll(session Session) bool {
+	if f.ReferrerFilter != "" {
+		source, _ := session.sourceAndChannel()
+		if !strings.Contains(strings.ToLower(session.Referrer), strings.ToLower(f.ReferrerFilter)) &&
+			!strings.EqualFold(source, f.ReferrerFilter) {
+			return false
+		}
+	}
+	if f.Page != "" && !session.visited(f.Page) {
+		return false
+	}
+	if f.Country != "" && !strings.EqualFold(session.Country, f.Country) {
+		return false
+	}
+	if f.Device != "" && !strings.EqualFold(session.Device, f.Device) {
+		return false
+	}
+	if f.Campaign != "" && session.Campaign != f.Campaign && session.CampaignSource != f.Campaign {
+		return false
+	}
+	if f.Bot && session.Bot == "" {
+		return false
+	}
+	if f.MinScore != 0 || f.MaxScore != 0 {
+		score := session.score()
+		if f.MinScore != 0 && score < f.MinScore {
+			return false
+		}
+		if f.MaxScore != 0 && score > f.MaxScore {
+			return false
+		}
+	}
+	return true
+}
+
+func (f Filter) apply(sessions []Session) []Session {
+	if f.empty() {
+		return sessions
+	}
+
+	var filtered []Session
+	for _, session := range sessions {
+		if f.matches(session) {
+			filtered = append(filtered, session)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+var filterSessions = []Session{
+	{Referrer: "www.google.com/", Source: "Google", Channel: "search", Country: "BR", Device: "mobile",
+		Events: []interface{}{"/", "/pricing", 5}},
+	{Referrer: "news.ycombinator.com/item?id=1", Country: "US", Device: "desktop", Bot: "headlesschrome",
+		Events: []interface{}{"/"}},
+	{Referrer: "", Channel: "direct", Country: "us", Device: "desktop", Campaign: "launch",
+		Events: []interface{}{"/blog", 2.0}},
+	{Referrer: "t.co/abc", Source: "Twitter", Channel: "social", CampaignSource: "launch",
+		Events: []interface{}{"/pricing", "/signup", 10}},
+}
+
+func TestFilterApply(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		filter   Filter
+		expected []int // indexes in filterSessions
+	}{
+		{"empty", Filter{}, []int{0, 1, 2, 3}},
+		{"not alone", Filter{Not: true}, []int{0, 1, 2, 3}},
+		{"referrer part", Filter{ReferrerFilter: "ycombinator"}, []int{1}},
+		{"source name", Filter{ReferrerFilter: "google"}, []int{0}},
+		{"source of an old session", Filter{ReferrerFilter: "Hacker News"}, []int{1}},
+		{"page", Filter{Page: "/pricing"}, []int{0, 3}},
+		{"not page", Filter{Page: "/pricing", Not: true}, []int{1, 2}},
+		{"country", Filter{Country: "US"}, []int{1, 2}},
+		{"country and device", Filter{Country: "br", Device: "mobile"}, []int{0}},
+		{"campaign or campaign source", Filter{Campaign: "launch"}, []int{2, 3}},
+		{"min score", Filter{MinScore: 3}, []int{0, 2, 3}},
+		{"max score", Filter{MaxScore: 3}, []int{1, 2}},
+		{"score range", Filter{MinScore: 4, MaxScore: 8}, []int{0}},
+		{"not all of them", Filter{Country: "us", Device: "desktop", Not: true}, []int{0, 3}},
+		{"bots", Filter{Bot: true}, []int{1}},
+		{"not bots", Filter{Bot: true, Not: true}, []int{0, 2, 3}},
+		{"nothing", Filter{Country: "PT"}, nil},
+	} {
+		filtered := test.filter.apply(filterSessions)
+		if len(filtered) != len(test.expected) {
+			t.Errorf("%s: got %d sessions, expected %d", test.name, len(filtered), len(test.expected))
+			continue
+		}
+		for i, index := range test.expected {
+			if filtered[i].Referrer != filterSessions[index].Referrer {
+				t.Errorf("%s: got session %q, expected %q",
+					test.name, filtered[i].Referrer, filterSessions[index].Referrer)
+			}
+		}
+	}
+}
+
+func TestFilterEmpty(t *testing.T) {
+	if !(Filter{}).empty() || !(Filter{Not: true}).empty() {
+		t.Error("filters without conditions should be empty")
+	}
+	if (Filter{Page: "/"}).empty() || (Filter{MinScore: 1, Not: true}).empty() {
+		t.Error("filters with conditions should not be empty")
+	}
+}
+
+// segments are filters applied one at a time to the same sessions, so a
+// segment and its negation must add up to all of them.
+func TestSegmentsAddUp(t *testing.T) {
+	day := Day{sessions: filterSessions}
+	total := day.stats()
+
+	for _, filter := range []Filter{
+		{Page: "/pricing"},
+		{Country: "us"},
+		{MinScore: 3},
+		{ReferrerFilter: "google", Device: "mobile"},
+	} {
+		segments := []Segment{{Name: "in", Filter: filter}, {Name: "out", Filter: filter}}
+		segments[1].Not = true
+
+		var sum Stats
+		for _, segment := range segments {
+			sum.add(Day{sessions: segment.Filter.apply(day.sessions)}.stats())
+		}
+		if sum != total {
+			t.Errorf("%+v: segments add up to %+v, expected %+v", filter, sum, total)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/ogier/pflag"
+	"github.com/valyala/fasthttp"
+	"gopkg.in/redis.v5"
+)
+
+// tools for answering data deletion and access requests, available both as
+// commands and, when ADMIN_TOKEN is set, as endpoints under /admin/.
+
+var (
+	errInvalidDomain  = errors.New("invalid domain")
+	errInvalidSession = errors.New("invalid session id or domain")
+)
+
+// deleteDomain removes everything we have about a site, both the days still on
+// redis and everything already compiled to postgres.
+// hits being tracked while this runs may still show up afterwards.
+func deleteDomain(domain string) (err error) {
+	if domain == "" || strings.ContainsAny(domain, "*?[]") {
+		return errInvalidDomain
+	}
+
+	// sessions, their attributes and all the per-day keys
+	var keys []string
+	for _, pattern := range []string{
+		makeBaseKey(domain, "*"),
+		makeAttrsKey(makeBaseKey(domain, "*")),
+		makeIndexKey(domain, "*"),
+		makeStatsKey(domain, "*"),
+		makeFilteredKey(domain, "*"),
+		makeVisitorsKey(domain, "*"),
+	} {
+		iter := rds.Scan(0, pattern, 1000).Iterator()
+		for iter.Next() {
+			keys = append(keys, iter.Val())
+		}
+		if err = iter.Err(); err != nil {
+			return
+		}
+	}
+	keys = append(keys, makeActiveKey(domain), makeDomainBucketKey(domain))
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 1000 {
+			n = 1000
+		}
+		if err = rds.Del(keys[:n]...).Err(); err != nil {
+			return
+		}
+		keys = keys[n:]
+	}
+
+	// so the daily routine doesn't try to compile it
+	iter := rds.Scan(0, "compile:*", 1000).Iterator()
+	for iter.Next() {
+		if err = rds.SRem(iter.Val(), domain).Err(); err != nil {
+			return
+		}
+	}
+	if err = iter.Err(); err != nil {
+		return
+	}
+
+	tx, err := pg.Beginx()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`DELETE FROM days WHERE domain = $1`, domain); err != nil {
+		return
+	}
+	if _, err = tx.Exec(`DELETE FROM months WHERE domain = $1`, domain); err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+// StoredSession is a session as found by findSession.
+type StoredSession struct {
+	Domain  string  `json:"domain"`
+	Day     string  `json:"day"`
+	Where   string  `json:"where"` // "redis" or "postgres"
+	Session Session `json:"session"`
+
+	key string // on redis
+}
+
+// findSession looks for a session by its cuid (the value the tracker keeps on
+// localStorage) on all sites, or only on `domain` if it is given.
+// sessions compiled to postgres before we started storing their ids can't be
+// found.
+func findSession(domain, id string) (found []StoredSession, err error) {
+	if id == "" || strings.ContainsAny(id, "*?[]:") ||
+		strings.ContainsAny(domain, "*?[]") {
+		return nil, errInvalidSession
+	}
+
+	pattern := "*:*:" + id
+	if domain != "" {
+		pattern = redisKeyFactory(domain, "*")(id)
+	}
+	iter := rds.Scan(0, pattern, 1000).Iterator()
+	for iter.Next() {
+		key := iter.Val()
+		parts := strings.Split(key, ":")
+		if len(parts) != 3 {
+			continue // attrs:..., or some other key that happens to match
+		}
+		day := dayFromSessionKeys(parts[0], parts[1], []string{key})
+		for _, session := range day.sessions {
+			found = append(found, StoredSession{parts[0], parts[1], "redis", session, key})
+		}
+	}
+	if err = iter.Err(); err != nil {
+		return
+	}
+
+	var days []struct {
+		Domain string `db:"domain"`
+		Day
+	}
+	contains, _ := json.Marshal([]map[string]string{{"id": id}})
+	err = pg.Select(&days, `
+SELECT domain, day, sessions FROM days
+WHERE sessions @> $1 AND ($2 = '' OR domain = $2)
+    `, types.JSONText(contains), domain)
+	if err != nil {
+		return
+	}
+	for _, row := range days {
+		if err = json.Unmarshal(row.RawSessions, &row.sessions); err != nil {
+			return
+		}
+		for _, session := range row.sessions {
+			if session.ID == id {
+				found = append(found, StoredSession{row.Domain, row.Day.Day, "postgres", session, ""})
+			}
+		}
+	}
+	return
+}
+
+// deleteSessionScript removes a session from redis and takes it out of the day
+// totals, counting its events the same way trackScript did when they came, so
+// events tracked while we're deleting it can't make the totals wrong.
+// returns 1 if the session was there.
+//
+// KEYS: session list, session attributes, day index, day totals, day visitors
+var deleteSessionScript = redis.NewScript(`
+local events = redis.call('LRANGE', KEYS[1], 1, -1)
+local visitor = redis.call('HGET', KEYS[2], 'visitor')
+redis.call('DEL', KEYS[1], KEYS[2])
+redis.call('SREM', KEYS[3], KEYS[1])
+
+-- the visitor is only gone if none of their other sessions are left.
+-- (the attributes keys are made from the session keys, see makeAttrsKey())
+if visitor and visitor ~= '' then
+  local others = false
+  for _, key in ipairs(redis.call('SMEMBERS', KEYS[3])) do
+    if redis.call('HGET', 'attrs:' .. key, 'visitor') == visitor then
+      others = true
+      break
+    end
+  end
+  if not others then
+    redis.call('SREM', KEYS[5], visitor)
+  end
+end
+
+-- days from before we kept the totals don't have them
+if #events == 0 or redis.call('EXISTS', KEYS[4]) == 0 then
+  return #events > 0 and 1 or 0
+end
+
+local pageviews, score = 0, 0
+for _, e in ipairs(events) do
+  local points = tonumber(e)
+  if points == nil then
+    pageviews = pageviews + 1
+    score = score + 1
+  else
+    score = score + points
+  end
+end
+
+redis.call('HINCRBY', KEYS[4], 'nsessions', -1)
+if #events == 1 and (tonumber(events[1]) == nil or tonumber(events[1]) == 0) then
+  redis.call('HINCRBY', KEYS[4], 'nbounces', -1)
+end
+redis.call('HINCRBY', KEYS[4], 'npageviews', -pageviews)
+redis.call('HINCRBY', KEYS[4], 'score', -score)
+return 1
+`)
+
+// deleteSessionFromRedis runs deleteSessionScript on a session key.
+func deleteSessionFromRedis(domain, day, key string) (existed bool, err error) {
+	n, err := deleteSessionScript.Run(rds, []string{
+		key,
+		makeAttrsKey(key),
+		makeIndexKey(domain, day),
+		makeStatsKey(domain, day),
+		makeVisitorsKey(domain, day),
+	}).Int64()
+	return n == 1, err
+}
+
+// deleteSession removes a session from everywhere it is found, and returns
+// what was removed. the totals for the day are corrected, but months already
+// compiled keep counting it.
+func deleteSession(domain, id string) (deleted []StoredSession, err error) {
+	deleted, err = findSession(domain, id)
+	if err != nil {
+		return
+	}
+
+	for _, stored := range deleted {
+		switch stored.Where {
+		case "redis":
+			_, err = deleteSessionFromRedis(stored.Domain, stored.Day, stored.key)
+		case "postgres":
+			_, err = pg.Exec(`
+UPDATE days SET sessions = (
+  SELECT coalesce(jsonb_agg(session), '[]')
+  FROM jsonb_array_elements(sessions) AS session
+  WHERE session->>'id' IS DISTINCT FROM $3
+)
+WHERE domain = $1 AND day = $2
+            `, stored.Domain, stored.Day, id)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func handleAdmin(c *fasthttp.RequestCtx, path string) {
+	auth := string(c.Request.Header.Peek("Authorization"))
+	if s.AdminToken == "" ||
+		subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+s.AdminToken)) != 1 {
+		c.Error("unauthorized", 401)
+		return
+	}
+
+	domain := string(c.QueryArgs().Peek("domain"))
+	id := string(c.QueryArgs().Peek("session"))
+	logger := log.With().Str("request_id", requestID(c)).
+		Str("domain", domain).Str("session", id).Logger()
+
+	var result interface{}
+	var err error
+	method := string(c.Method())
+	switch {
+	case path == "domain" && method == "DELETE":
+		err = deleteDomain(domain)
+		result = map[string]bool{"ok": err == nil}
+	case path == "session" && method == "GET":
+		result, err = findSession(domain, id)
+	case path == "session" && method == "DELETE":
+		result, err = deleteSession(domain, id)
+	default:
+		c.Error("not found", 404)
+		return
+	}
+
+	if err == errInvalidDomain || err == errInvalidSession {
+		c.Error(err.Error(), 400)
+		return
+	} else if err != nil {
+		logger.Warn().Err(err).Str("admin", path).Msg("admin request failed")
+		c.Error(err.Error(), 500)
+		return
+	}
+	logger.Info().Str("admin", path).Str("method", method).Msg("admin request")
+
+	body, _ := json.Marshal(result)
+	c.SetContentType("application/json")
+	c.SetBody(body)
+}
+
+// the commands
+
+func deleteDomainCommand() {
+	var domain string
+	pflag.StringVar(&domain, "domain", "", "the site to delete")
+	pflag.Parse()
+
+	if err := deleteDomain(domain); err != nil {
+		log.Fatal().Err(err).Str("domain", domain).Msg("failed to delete domain")
+	}
+	log.Info().Str("domain", domain).Msg("deleted all data for domain")
+}
+
+func sessionCommand(remove bool) {
+	var domain, id string
+	pflag.StringVar(&domain, "domain", "", "look only on this site (default is all)")
+	pflag.StringVar(&id, "session", "", "the session cuid")
+	pflag.Parse()
+
+	var sessions []StoredSession
+	var err error
+	if remove {
+		sessions, err = deleteSession(domain, id)
+	} else {
+		sessions, err = findSession(domain, id)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Str("session", id).Msg("failed to find session")
+	}
+
+	// printed to stdout, so it can be redirected to a file
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(sessions)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lucsky/cuid"
+	"github.com/valyala/fasthttp"
+)
+
+func TestDeleteSessionScript(t *testing.T) {
+	testRedis(t)
+	domain := "deletesession.invalid"
+	today := presentDay().Format(DATEFORMAT)
+	deleteDayFromRedis(domain, today)
+	defer deleteDayFromRedis(domain, today)
+
+	// the deleted session has the same visitor as the kept one, so that
+	// visitor is still counted, but not the one of the bounce.
+	kept, bounced, deleted := cuid.New(), cuid.New(), cuid.New()
+	for _, h := range []hit{
+		{session: kept, newSession: true, event: "/", attrs: map[string]string{"visitor": "v1"}},
+		{session: kept, event: 3},
+		{session: bounced, newSession: true, event: "/", attrs: map[string]string{"visitor": "v2"}},
+		{session: deleted, newSession: true, event: "/", attrs: map[string]string{"visitor": "v1"}},
+		{session: deleted, event: "/pricing"},
+		{session: deleted, event: 7},
+	} {
+		h.domain, h.day, h.referrer = domain, today, "t.co/"
+		if _, err := storeHit(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, session := range []string{deleted, bounced} {
+		existed, err := deleteSessionFromRedis(domain, today, redisKeyFactory(domain, today)(session))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !existed {
+			t.Errorf("deleting %s: it should have existed", session)
+		}
+	}
+
+	// the totals are the same as if only the kept session had been tracked
+	stats, _, err := statsFromRedis(domain, today)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := dayFromRedis(domain, today)
+	if len(day.sessions) != 1 || day.sessions[0].ID != kept {
+		t.Fatalf("expected only %s to be left, got %+v", kept, day.sessions)
+	}
+	if computed := day.stats(); stats != computed || stats.NVisitors != 1 {
+		t.Errorf("totals = %+v after deleting, expected %+v with 1 visitor", stats, computed)
+	}
+
+	// deleting it again changes nothing
+	existed, _ := deleteSessionFromRedis(domain, today, redisKeyFactory(domain, today)(deleted))
+	if again, _, _ := statsFromRedis(domain, today); existed || again != stats {
+		t.Errorf("deleting twice: existed = %v, left totals %+v", existed, again)
+	}
+}
+
+func TestAdminValidation(t *testing.T) {
+	defer func(old Settings) { s = old }(s)
+	s.AdminToken = "secret"
+
+	for _, test := range []struct {
+		method string
+		path   string
+		query  string
+		token  string
+		status int
+	}{
+		{"DELETE", "domain", "", "secret", 400},
+		{"DELETE", "domain", "domain=*", "secret", 400},
+		{"GET", "session", "", "secret", 400},
+		{"DELETE", "session", "session=a*", "secret", 400},
+		{"GET", "session", "session=abc&domain=x?", "secret", 400},
+		{"GET", "nothing", "", "secret", 404},
+		{"DELETE", "domain", "domain=a.com", "wrong", 401},
+	} {
+		var c fasthttp.RequestCtx
+		c.Request.Header.SetMethod(test.method)
+		c.Request.SetRequestURI("/admin/" + test.path + "?" + test.query)
+		c.Request.Header.Set("Authorization", "Bearer "+test.token)
+
+		handleAdmin(&c, test.path)
+		if status := c.Response.StatusCode(); status != test.status {
+			t.Errorf("%s /admin/%s?%s: got status %d, expected %d",
+				test.method, test.path, test.query, status, test.status)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// geoDB is a minimal reader for MaxMind DB files (like GeoLite2-Country.mmdb
+// or GeoLite2-City.mmdb), enough to get a country and a region for an IP.
+// the spec is at https://maxmind.github.io/MaxMind-DB/
+type geoDB struct {
+	tree       []byte
+	data       decoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+var geodb *geoDB
+
+var errInvalidGeoDB = errors.New("invalid MaxMind DB file")
+
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+func openGeoDB(path string) (*geoDB, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseGeoDB(buf)
+}
+
+func parseGeoDB(buf []byte) (*geoDB, error) {
+	metastart := bytes.LastIndex(buf, metadataMarker)
+	if metastart == -1 {
+		return nil, errInvalidGeoDB
+	}
+	imeta, _, err := decoder(buf[metastart+len(metadataMarker):]).decode(0)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := imeta.(map[string]interface{})
+	if !ok {
+		return nil, errInvalidGeoDB
+	}
+
+	nodeCount, _ := meta["node_count"].(uint64)
+	recordSize, _ := meta["record_size"].(uint64)
+	ipVersion, _ := meta["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, errInvalidGeoDB
+	}
+	if nodeCount > uint64(metastart) {
+		return nil, errInvalidGeoDB
+	}
+
+	treesize := int(nodeCount * recordSize / 4)
+	if treesize+16 > metastart {
+		return nil, errInvalidGeoDB
+	}
+
+	db := &geoDB{
+		tree:       buf[:treesize],
+		data:       decoder(buf[treesize+16 : metastart]),
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+	}
+
+	// ipv4 addresses live under ::/96 in ipv6 databases
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.readRecord(db.ipv4Start, 0)
+		}
+	}
+
+	return db, nil
+}
+
+// lookup returns the ISO code of the country and of the region (like "BR" and
+// "BR-SP"). both are empty if the IP is not found. regions are only available
+// on the City databases.
+func (db *geoDB) lookup(ip net.IP) (country, region string) {
+	record, ok := db.find(ip)
+	if !ok {
+		return
+	}
+
+	for _, field := range []string{"country", "registered_country"} {
+		if c, ok := record[field].(map[string]interface{}); ok {
+			country, _ = c["iso_code"].(string)
+			break
+		}
+	}
+	if subdivisions, ok := record["subdivisions"].([]interface{}); ok && len(subdivisions) > 0 {
+		if sub, ok := subdivisions[0].(map[string]interface{}); ok && country != "" {
+			if code, _ := sub["iso_code"].(string); code != "" {
+				region = country + "-" + code
+			}
+		}
+	}
+	return
+}
+
+func (db *geoDB) find(ip net.IP) (map[string]interface{}, bool) {
+	var bits []byte
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		node = db.ipv4Start
+	} else if db.ipVersion == 6 {
+		bits = ip.To16()
+	}
+	if bits == nil {
+		return nil, false
+	}
+
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		bit := uint(bits[i>>3]>>(7-uint(i%8))) & 1
+		node = db.readRecord(node, bit)
+	}
+	if node <= db.nodeCount {
+		// node == nodeCount means "not found"
+		return nil, false
+	}
+
+	value, _, err := db.data.decode(int(node - db.nodeCount - 16))
+	if err != nil {
+		return nil, false
+	}
+	record, ok := value.(map[string]interface{})
+	return record, ok
+}
+
+func (db *geoDB) readRecord(node, bit uint) uint {
+	t := db.tree
+	switch db.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(t[off])<<16 | uint(t[off+1])<<8 | uint(t[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(t[off+3]&0xF0)<<20 | uint(t[off])<<16 | uint(t[off+1])<<8 | uint(t[off+2])
+		}
+		return uint(t[off+3]&0x0F)<<24 | uint(t[off+4])<<16 | uint(t[off+5])<<8 | uint(t[off+6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(t[off : off+4]))
+	}
+}
+
+// decoder reads values from the data section (or from the metadata).
+// pointers are offsets relative to the start of it.
+type decoder []byte
+
+// real databases nest only a few levels deep, anything past this is a
+// corrupt file with pointers going around in circles.
+const maxDecodeDepth = 32
+
+func (d decoder) decode(offset int) (value interface{}, next int, err error) {
+	return d.decodeAt(offset, 0)
+}
+
+func (d decoder) decodeAt(offset, depth int) (value interface{}, next int, err error) {
+	if offset < 0 || offset >= len(d) || depth > maxDecodeDepth {
+		return nil, 0, errInvalidGeoDB
+	}
+	ctrl := d[offset]
+	offset++
+
+	typ := int(ctrl >> 5)
+	if typ == 1 {
+		// pointer
+		n := int(ctrl>>3)&3 + 1
+		if offset+n > len(d) {
+			return nil, 0, errInvalidGeoDB
+		}
+		b := d[offset : offset+n]
+		vvv := int(ctrl & 7)
+
+		var pointer int
+		switch n {
+		case 1:
+			pointer = vvv<<8 | int(b[0])
+		case 2:
+			pointer = (vvv<<16 | int(b[0])<<8 | int(b[1])) + 2048
+		case 3:
+			pointer = (vvv<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])) + 526336
+		case 4:
+			pointer = int(binary.BigEndian.Uint32(b))
+		}
+
+		// pointers to pointers are not allowed
+		if pointer < len(d) && d[pointer]>>5 == 1 {
+			return nil, 0, errInvalidGeoDB
+		}
+		value, _, err = d.decodeAt(pointer, depth+1)
+		return value, offset + n, err
+	}
+
+	if typ == 0 {
+		// extended type
+		if offset >= len(d) {
+			return nil, 0, errInvalidGeoDB
+		}
+		typ = 7 + int(d[offset])
+		offset++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(d) {
+			return nil, 0, errInvalidGeoDB
+		}
+		b := d[offset : offset+n]
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + int(b[0])
+		case 2:
+			size = 285 + (int(b[0])<<8 | int(b[1]))
+		case 3:
+			size = 65821 + (int(b[0])<<16 | int(b[1])<<8 | int(b[2]))
+		}
+	}
+
+	// every item in a map or array takes at least a byte
+	if (typ == 7 || typ == 11) && size > len(d)-offset {
+		return nil, 0, errInvalidGeoDB
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			var k, v interface{}
+			if k, offset, err = d.decodeAt(offset, depth+1); err != nil {
+				return
+			}
+			if v, offset, err = d.decodeAt(offset, depth+1); err != nil {
+				return
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errInvalidGeoDB
+			}
+			m[key] = v
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, size)
+		for i := 0; i < size; i++ {
+			if a[i], offset, err = d.decodeAt(offset, depth+1); err != nil {
+				return
+			}
+		}
+		return a, offset, nil
+	case 14: // boolean, the value is in the size
+		return size != 0, offset, nil
+	}
+
+	if offset+size > len(d) {
+		return nil, 0, errInvalidGeoDB
+	}
+	b := d[offset : offset+size]
+	next = offset + size
+
+	switch typ {
+	case 2: // utf-8 string
+		return string(b), next, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errInvalidGeoDB
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errInvalidGeoDB
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		if size > 8 {
+			return nil, 0, errInvalidGeoDB
+		}
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, next, nil
+	case 8: // int32
+		if size > 4 {
+			return nil, 0, errInvalidGeoDB
+		}
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(u)), next, nil
+		}
+		return int64(u), next, nil
+	case 4, 10: // bytes, uint128
+		return []byte(b), next, nil
+	default:
+		return nil, 0, errInvalidGeoDB
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// helpers to write the MaxMind DB data format.
+
+func mmdbCtrl(typ, size int) []byte {
+	var ctrl []byte
+	if typ > 7 {
+		ctrl = []byte{0, byte(typ - 7)}
+	} else {
+		ctrl = []byte{byte(typ << 5)}
+	}
+	switch {
+	case size < 29:
+		ctrl[0] |= byte(size)
+	case size < 285:
+		ctrl[0] |= 29
+		ctrl = append(ctrl, byte(size-29))
+	default:
+		ctrl[0] |= 30
+		ctrl = append(ctrl, byte((size-285)>>8), byte(size-285))
+	}
+	return ctrl
+}
+
+func mmdbString(s string) []byte {
+	return append(mmdbCtrl(2, len(s)), s...)
+}
+
+func mmdbUint(typ int, n uint64) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append(mmdbCtrl(typ, len(b)), b...)
+}
+
+// keys and values, alternated.
+func mmdbMap(kv ...[]byte) []byte {
+	out := mmdbCtrl(7, len(kv)/2)
+	for _, b := range kv {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func mmdbArray(items ...[]byte) []byte {
+	out := mmdbCtrl(11, len(items))
+	for _, b := range items {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func mmdbPointer(offset int) []byte {
+	return []byte{0x20 | byte(offset>>8&7), byte(offset)}
+}
+
+func mmdbRecord(country, region string) []byte {
+	fields := [][]byte{
+		mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString(country)),
+	}
+	if region != "" {
+		fields = append(fields,
+			mmdbString("subdivisions"), mmdbArray(mmdbMap(mmdbString("iso_code"), mmdbString(region))))
+	}
+	return mmdbMap(fields...)
+}
+
+type testNetwork struct {
+	cidr   string
+	offset int // in the data section
+}
+
+// buildGeoDB writes a database with the given networks pointing to records
+// in the given data section.
+func buildGeoDB(recordSize, ipVersion int, networks []testNetwork, data []byte) []byte {
+	// -1 is "not found", -2-n is the data at offset n, anything else a node.
+	nodes := [][2]int{{-1, -1}}
+	for _, network := range networks {
+		ip, ipnet, err := net.ParseCIDR(network.cidr)
+		if err != nil {
+			panic(err)
+		}
+		prefix, _ := ipnet.Mask.Size()
+		bits := []byte(ip.To4())
+		if ip.To4() == nil || ipVersion == 6 {
+			bits = ip.To16()
+			if ip.To4() != nil {
+				// ipv4 goes under ::/96, not under ::ffff:0:0/96
+				bits = append(make([]byte, 12), ip.To4()...)
+				prefix += 96
+			}
+		}
+
+		node := 0
+		for i := 0; i < prefix; i++ {
+			bit := bits[i>>3] >> (7 - uint(i%8)) & 1
+			if i == prefix-1 {
+				nodes[node][bit] = -2 - network.offset
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	nodeCount := len(nodes)
+	value := func(record int) uint32 {
+		switch {
+		case record == -1:
+			return uint32(nodeCount)
+		case record < -1:
+			return uint32(nodeCount + 16 - 2 - record)
+		}
+		return uint32(record)
+	}
+
+	var tree []byte
+	for _, node := range nodes {
+		left, right := value(node[0]), value(node[1])
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left),
+				byte(left>>24&0xF)<<4|byte(right>>24&0xF),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 32:
+			var b [8]byte
+			binary.BigEndian.PutUint32(b[:4], left)
+			binary.BigEndian.PutUint32(b[4:], right)
+			tree = append(tree, b[:]...)
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(tree)
+	buf.Write(make([]byte, 16))
+	buf.Write(data)
+	buf.Write(metadataMarker)
+	buf.Write(mmdbMap(
+		mmdbString("node_count"), mmdbUint(6, uint64(nodeCount)),
+		mmdbString("record_size"), mmdbUint(5, uint64(recordSize)),
+		mmdbString("ip_version"), mmdbUint(5, uint64(ipVersion)),
+	))
+	return buf.Bytes()
+}
+
+// a database like the real ones, with a City and a Country record.
+func testGeoDB(recordSize, ipVersion int) []byte {
+	br := mmdbRecord("BR", "SP")
+	us := mmdbRecord("US", "")
+	networks := []testNetwork{
+		{"200.0.0.0/8", 0},
+		{"8.8.8.0/24", len(br)},
+	}
+	if ipVersion == 6 {
+		networks = append(networks, testNetwork{"2001:db8::/32", len(br)})
+	}
+	return buildGeoDB(recordSize, ipVersion, networks, append(br, us...))
+}
+
+func TestGeoDBLookup(t *testing.T) {
+	for _, recordSize := range []int{24, 28, 32} {
+		for _, ipVersion := range []int{4, 6} {
+			db, err := parseGeoDB(testGeoDB(recordSize, ipVersion))
+			if err != nil {
+				t.Fatalf("record size %d, ipv%d: %s", recordSize, ipVersion, err)
+			}
+
+			for _, test := range []struct {
+				ip      string
+				country string
+				region  string
+			}{
+				{"200.1.2.3", "BR", "BR-SP"},
+				{"200.255.255.255", "BR", "BR-SP"},
+				{"8.8.8.8", "US", ""},
+				{"8.8.4.4", "", ""},
+				{"10.0.0.1", "", ""},
+				{"::ffff:200.1.2.3", "BR", "BR-SP"},
+			} {
+				country, region := db.lookup(net.ParseIP(test.ip))
+				if country != test.country || region != test.region {
+					t.Errorf("record size %d, ipv%d: lookup(%s) = %q, %q, expected %q, %q",
+						recordSize, ipVersion, test.ip, country, region, test.country, test.region)
+				}
+			}
+
+			country, _ := db.lookup(net.ParseIP("2001:db8::1"))
+			if ipVersion == 6 && country != "US" {
+				t.Errorf("record size %d, ipv6: lookup(2001:db8::1) = %q, expected US", recordSize, country)
+			}
+			if ipVersion == 4 && country != "" {
+				t.Errorf("record size %d, ipv4: lookup(2001:db8::1) = %q, expected nothing", recordSize, country)
+			}
+		}
+	}
+}
+
+func TestGeoDBPointersAndRegisteredCountry(t *testing.T) {
+	// the record points to a country map stored before it, like real
+	// databases do to deduplicate values.
+	country := mmdbMap(mmdbString("iso_code"), mmdbString("PT"))
+	key := mmdbString("registered_country")
+	data := append(append([]byte{}, country...), key...)
+	data = append(data, mmdbMap(mmdbPointer(len(country)), mmdbPointer(0))...)
+
+	db, err := parseGeoDB(buildGeoDB(24, 4, []testNetwork{{"1.0.0.0/8", len(country) + len(key)}}, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if country, region := db.lookup(net.ParseIP("1.2.3.4")); country != "PT" || region != "" {
+		t.Errorf("lookup(1.2.3.4) = %q, %q, expected \"PT\", \"\"", country, region)
+	}
+}
+
+func TestGeoDBCorrupt(t *testing.T) {
+	valid := testGeoDB(28, 6)
+
+	// truncated anywhere, including in the middle of the metadata
+	for n := 0; n < len(valid); n++ {
+		checkCorruptGeoDB(t, "truncated", valid[:n])
+	}
+
+	// garbage in the tree and in the data section
+	for i := 0; i < len(valid)-len(metadataMarker)-40; i++ {
+		corrupt := append([]byte{}, valid...)
+		corrupt[i] ^= 0xFF
+		checkCorruptGeoDB(t, "flipped", corrupt)
+	}
+
+	for name, data := range map[string][]byte{
+		"pointer loop":       mmdbMap(mmdbString("country"), mmdbPointer(0)),
+		"pointer to pointer": append(mmdbPointer(2), mmdbPointer(0)...),
+		"pointer too far":    mmdbPointer(2000),
+		"huge map":           append(mmdbCtrl(7, 60000), mmdbString("country")...),
+		"huge array":         append(mmdbCtrl(11, 60000), mmdbString("BR")...),
+		"key not a string":   mmdbMap(mmdbUint(5, 1), mmdbString("BR")),
+	} {
+		db, err := parseGeoDB(buildGeoDB(24, 4, []testNetwork{{"1.0.0.0/8", 0}}, data))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if country, region := db.lookup(net.ParseIP("1.2.3.4")); country != "" || region != "" {
+			t.Errorf("%s: lookup(1.2.3.4) = %q, %q, expected nothing", name, country, region)
+		}
+	}
+
+	// a record pointing inside the 16 bytes between the tree and the data
+	db, err := parseGeoDB(testGeoDB(24, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.tree[0], db.tree[1], db.tree[2] = 0, 0, byte(db.nodeCount+3)
+	checkCorruptLookups(t, "record in the gap", db)
+
+	// a node count bigger than the file
+	huge := buildGeoDB(24, 4, nil, nil)
+	huge = append(huge[:bytes.LastIndex(huge, metadataMarker)+len(metadataMarker)], mmdbMap(
+		mmdbString("node_count"), mmdbUint(9, 1<<62),
+		mmdbString("record_size"), mmdbUint(5, 32),
+		mmdbString("ip_version"), mmdbUint(5, 6),
+	)...)
+	if _, err := parseGeoDB(huge); err == nil {
+		t.Error("a node count bigger than the file should be invalid")
+	}
+}
+
+func checkCorruptGeoDB(t *testing.T, name string, buf []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("%s (%d bytes): panicked while opening: %v", name, len(buf), r)
+		}
+	}()
+
+	if db, err := parseGeoDB(buf); err == nil {
+		checkCorruptLookups(t, name, db)
+	}
+}
+
+func checkCorruptLookups(t *testing.T, name string, db *geoDB) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("%s: panicked on lookup: %v", name, r)
+		}
+	}()
+
+	for _, ip := range []string{"200.1.2.3", "8.8.8.8", "10.0.0.1", "2001:db8::1", "::1"} {
+		db.lookup(net.ParseIP(ip))
+	}
+}
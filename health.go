@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/redis.v5"
+)
+
+type healthCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Info  string `json:"info,omitempty"`
+}
+
+// handleHealthz only tells the process is up and serving requests.
+func handleHealthz(c *fasthttp.RequestCtx) {
+	sendHealth(c, true, nil)
+}
+
+// handleReadyz tells whether we can actually track hits and answer queries.
+func handleReadyz(c *fasthttp.RequestCtx) {
+	checks := map[string]healthCheck{
+		"redis":     checkError(rds.Ping().Err()),
+		"postgres":  checkPostgres(),
+		"blacklist": checkBlacklist(),
+		"daily":     checkDaily(),
+	}
+
+	ready := true
+	for _, check := range checks {
+		ready = ready && check.OK
+	}
+	sendHealth(c, ready, checks)
+}
+
+func checkError(err error) healthCheck {
+	if err != nil {
+		return healthCheck{OK: false, Error: err.Error()}
+	}
+	return healthCheck{OK: true}
+}
+
+// redis has its own timeouts on the client, postgres doesn't.
+func checkPostgres() healthCheck {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	return checkError(pg.PingContext(ctx))
+}
+
+// checkBlacklist only fails before any list is loaded. having just the small
+// embedded one (when we couldn't download the lists yet and had none cached,
+// like on an install that can't reach github) lets less spam through, but
+// that's no reason to stop tracking, so it's only reported.
+func checkBlacklist() healthCheck {
+	b := currentBlacklist()
+	switch b.source {
+	case "downloaded", "cached":
+		return healthCheck{OK: true, Info: b.source + " at " + b.fetchedAt.UTC().Format(time.RFC3339)}
+	case "embedded":
+		return healthCheck{OK: true, Info: "degraded: couldn't download the lists yet, using the embedded one"}
+	default:
+		return healthCheck{OK: false, Error: "not loaded"}
+	}
+}
+
+// checkDaily fails when the last successful run of the daily routine is older
+// than READY_MAX_DAILY_AGE. installs where it has never run are fine.
+func checkDaily() healthCheck {
+	if s.ReadyMaxDailyAge == 0 {
+		return healthCheck{OK: true, Info: "not checked"}
+	}
+
+	last, err := rds.HGet(makeRoutineKey("daily"), "last_success").Result()
+	if err == redis.Nil {
+		return healthCheck{OK: true, Info: "never ran"}
+	} else if err != nil {
+		return checkError(err)
+	}
+
+	unix, _ := strconv.ParseInt(last, 10, 64)
+	when := time.Unix(unix, 0).UTC()
+	check := healthCheck{OK: time.Since(when) <= s.ReadyMaxDailyAge, Info: "last success at " + when.Format(time.RFC3339)}
+	if !check.OK {
+		check.Error = "daily routine hasn't succeeded for " + time.Since(when).Truncate(time.Minute).String()
+	}
+	return check
+}
+
+func sendHealth(c *fasthttp.RequestCtx, ok bool, checks map[string]healthCheck) {
+	body, _ := json.Marshal(struct {
+		OK     bool                   `json:"ok"`
+		Checks map[string]healthCheck `json:"checks,omitempty"`
+	}{ok, checks})
+
+	c.SetContentType("application/json")
+	c.Response.Header.Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	if ok {
+		c.SetStatusCode(200)
+	} else {
+		c.SetStatusCode(503)
+	}
+	c.SetBody(body)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckBlacklist(t *testing.T) {
+	defer blacklist.Store(currentBlacklist())
+
+	for _, test := range []struct {
+		source string
+		ok     bool
+	}{
+		{"downloaded", true},
+		{"cached", true},
+		{"embedded", true},
+		{"", false},
+	} {
+		blacklist.Store(&referrerBlacklist{hosts: newHostTrie(), source: test.source, fetchedAt: time.Now()})
+		check := checkBlacklist()
+		if check.OK != test.ok {
+			t.Errorf("blacklist from %q: ok = %v, expected %v (%+v)", test.source, check.OK, test.ok, check)
+		}
+		if test.source == "embedded" && !strings.HasPrefix(check.Info, "degraded") {
+			t.Errorf("the embedded blacklist should be reported as degraded, got %+v", check)
+		}
+	}
+}
@@ -3,15 +3,17 @@ package main
 import (
 	"encoding/json"
 	"math/rand"
+	"net"
 	"net/url"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/PuerkitoBio/goquery"
 	"github.com/jmoiron/sqlx/types"
+	"github.com/lucsky/cuid"
 	"github.com/valyala/fasthttp"
+	"gopkg.in/redis.v5"
 )
 
 const (
@@ -19,6 +21,8 @@ const (
 	MONTHFORMAT = "200601"
 )
 
+const redisExpireInterval = time.Hour * 24 * 7
+
 func presentDay() time.Time {
 	now := time.Now().UTC()
 	y, m, d := now.Date()
@@ -32,7 +36,9 @@ func redisKeyFactory(code, day string) func(string) string {
 		return basekey + ":" + subkey
 	}
 }
-func makeMonthKey(code, month string) string { return code + "." + month }
+func makeAttrsKey(sessionkey string) string   { return "attrs:" + sessionkey }
+func makeFilteredKey(code, day string) string { return "filtered:" + makeBaseKey(code, day) }
+func makeMonthKey(code, month string) string  { return code + "." + month }
 
 func randomNumber(r int) int {
 	rand.Seed(time.Now().UnixNano())
@@ -40,34 +46,46 @@ func randomNumber(r int) int {
 }
 
 func dayFromRedis(domain, day string) Day {
+	return dayFromSessionKeys(domain, day, sessionKeys(domain, day))
+}
+
+func dayFromSessionKeys(domain, day string, sessionkeys []string) Day {
 	var sessions []Session
-	scankey := redisKeyFactory(domain, day)("*")
 
-	iter := rds.Scan(0, scankey, 100).Iterator()
-	for iter.Next() {
-		sessionkey := iter.Val()
-		events, err := rds.LRange(sessionkey, 0, -1).Result()
+	pipe := rds.Pipeline()
+	defer pipe.Close()
+	lists := make([]*redis.StringSliceCmd, len(sessionkeys))
+	attrs := make([]*redis.StringStringMapCmd, len(sessionkeys))
+	for i, sessionkey := range sessionkeys {
+		lists[i] = pipe.LRange(sessionkey, 0, -1)
+		attrs[i] = pipe.HGetAll(makeAttrsKey(sessionkey))
+	}
+	pipe.Exec() // errors are checked for each command below
+
+	for i, sessionkey := range sessionkeys {
+		events, err := lists[i].Result()
 		if err != nil {
 			log.Error().Str("skey", sessionkey).Err(err).
 				Msg("error reading session from redis")
 			continue
 		}
+		if len(events) == 0 {
+			// expired
+			continue
+		}
 
 		session := Session{
+			ID:       sessionkey[strings.LastIndex(sessionkey, ":")+1:],
 			Referrer: events[0],
 		}
+		if attrs, err := attrs[i].Result(); err == nil {
+			session.setAttributes(attrs)
+		}
 		for _, event := range events[1:] {
-			if points, err := strconv.Atoi(event); err == nil {
-				session.Events = append(session.Events, points)
-			} else {
-				session.Events = append(session.Events, event)
-			}
+			session.Events = append(session.Events, parseEvent(event))
 		}
 		sessions = append(sessions, session)
 	}
-	if err := iter.Err(); err != nil {
-		log.Error().Str("key", scankey).Err(err).Msg("error scanning from redis")
-	}
 
 	var rawsessions types.JSONText
 	rawsessions, _ = json.Marshal(sessions)
@@ -79,18 +97,50 @@ func dayFromRedis(domain, day string) Day {
 	}
 }
 
-func deleteDayFromRedis(domain, day string) error {
-	scankey := redisKeyFactory(domain, day)("*")
-
-	var sessionkeys []string
+// sessionKeys reads the index of session keys for the day.
+func sessionKeys(domain, day string) []string {
+	sessionkeys, err := rds.SMembers(makeIndexKey(domain, day)).Result()
+	if err != nil {
+		log.Error().Str("domain", domain).Str("day", day).Err(err).
+			Msg("error reading session index from redis")
+	}
+	return sessionkeys
+}
 
+// scanSessionKeys finds the sessions of days tracked before we started keeping
+// an index of them. it goes through the whole keyspace, so it's only used when
+// compiling those days, which happens once.
+func scanSessionKeys(domain, day string) (sessionkeys []string) {
+	scankey := redisKeyFactory(domain, day)("*")
 	iter := rds.Scan(0, scankey, 100).Iterator()
 	for iter.Next() {
-		sessionkey := iter.Val()
-		sessionkeys = append(sessionkeys, sessionkey)
+		sessionkeys = append(sessionkeys, iter.Val())
 	}
+	if err := iter.Err(); err != nil {
+		log.Error().Str("key", scankey).Err(err).Msg("error scanning from redis")
+	}
+	return sessionkeys
+}
 
-	return rds.Del(sessionkeys...).Err()
+// deleteDayFromRedis removes everything tracked for a site in a day, so it
+// won't be compiled either.
+func deleteDayFromRedis(domain, day string) error {
+	keys := []string{
+		makeIndexKey(domain, day),
+		makeStatsKey(domain, day),
+		makeFilteredKey(domain, day),
+		makeVisitorsKey(domain, day),
+	}
+	for _, sessionkey := range sessionKeys(domain, day) {
+		keys = append(keys, sessionkey, makeAttrsKey(sessionkey))
+	}
+
+	pipe := rds.Pipeline()
+	defer pipe.Close()
+	pipe.Del(keys...)
+	pipe.SRem("compile:"+day, domain)
+	_, err := pipe.Exec()
+	return err
 }
 
 func condenseQuery(query url.Values) string {
@@ -107,37 +157,72 @@ func condenseQuery(query url.Values) string {
 	return "?" + "{" + strings.Join(querykeys, ",") + "}"
 }
 
-func buildReferrerBlacklist() map[string]bool {
-	refmap := make(map[string]bool)
-
-	lines := ""
-	client := &fasthttp.Client{Name: "Mozilla/5.0 (X11; Linux i686) AppleWebKit/537.36 (KHTML, like Gecko) Ubuntu Chromium/56.0.2924.76 Chrome/56.0.2924.76 Safari/537.36"}
-	for _, u := range []string{
-		"https://raw.githubusercontent.com/piwik/referrer-spam-blacklist/master/spammers.txt",
-		"https://raw.githubusercontent.com/ddofborg/analytics-ghost-spam-list/master/adwordsrobot.com-spam-list.txt",
-	} {
-		r := fasthttp.AcquireRequest()
-		r.SetRequestURI(u)
+// referrerHost takes a referrer as stored in sessions (see track())
+// and returns just its hostname.
+func referrerHost(referrer string) string {
+	return strings.SplitN(referrer, "/", 2)[0]
+}
 
-		w := fasthttp.AcquireResponse()
-		err := client.DoTimeout(r, w, time.Second*25)
-		if err != nil {
-			continue
+// clientIP takes the address TRUSTED_PROXIES hops back in X-Forwarded-For,
+// which is the one seen by the outermost of our proxies (like the heroku
+// router), as anything before it may have been sent by the client.
+// without proxies it's the address of the connection.
+func clientIP(c *fasthttp.RequestCtx) net.IP {
+	if s.TrustedProxies > 0 {
+		var hops []string
+		c.Request.Header.VisitAll(func(key, value []byte) {
+			if string(key) == "X-Forwarded-For" {
+				hops = append(hops, strings.Split(string(value), ",")...)
+			}
+		})
+		if len(hops) >= s.TrustedProxies {
+			if ip := net.ParseIP(strings.TrimSpace(hops[len(hops)-s.TrustedProxies])); ip != nil {
+				return ip
+			}
 		}
-
-		lines += string(w.Body())
-		lines += "\n"
 	}
+	return c.RemoteIP()
+}
 
-	for _, line := range strings.Split(lines, "\n") {
-		refmap[strings.TrimSpace(line)] = true
+// requestID reuses the id given by the router or load balancer in front of us,
+// if any, and sends it back, so the logs can be matched.
+func requestID(c *fasthttp.RequestCtx) string {
+	id := string(c.Request.Header.Peek("X-Request-Id"))
+	if id == "" || len(id) > 200 {
+		id = cuid.New()
 	}
+	c.Response.Header.Set("X-Request-Id", id)
+	return id
+}
 
-	if doc, err := goquery.NewDocument("https://referrerspamblocker.com/blacklist"); err == nil {
-		doc.Find(".blacklist li").Each(func(i int, s *goquery.Selection) {
-			refmap[strings.TrimSpace(s.Text())] = true
-		})
+// screenBucket takes the viewport width sent by the tracker.
+func screenBucket(width string) string {
+	w, err := strconv.Atoi(width)
+	switch {
+	case err != nil || w <= 0:
+		return ""
+	case w < 768:
+		return "mobile"
+	case w < 1024:
+		return "tablet"
+	default:
+		return "desktop"
 	}
+}
 
-	return refmap
+// primaryLanguage takes navigator.language as sent by the tracker or, if that
+// is missing, the first language in the Accept-Language header, and returns
+// just the language part of it ("pt-BR" -> "pt").
+func primaryLanguage(navlang, acceptLanguage string) string {
+	lang := navlang
+	if lang == "" {
+		lang = strings.Split(acceptLanguage, ",")[0]
+	}
+	lang = strings.Split(lang, ";")[0]
+	lang = strings.Split(strings.Replace(lang, "_", "-", -1), "-")[0]
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if lang == "*" || len(lang) > 8 {
+		return ""
+	}
+	return lang
 }
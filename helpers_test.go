@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestScreenBucket(t *testing.T) {
+	for width, expected := range map[string]string{
+		"":      "",
+		"wide":  "",
+		"0":     "",
+		"-1":    "",
+		"1.5":   "",
+		"320":   "mobile",
+		"767":   "mobile",
+		"768":   "tablet",
+		"1023":  "tablet",
+		"1024":  "desktop",
+		"2560":  "desktop",
+		" 1024": "",
+	} {
+		if bucket := screenBucket(width); bucket != expected {
+			t.Errorf("screenBucket(%q) = %q, expected %q", width, bucket, expected)
+		}
+	}
+}
+
+func TestPrimaryLanguage(t *testing.T) {
+	for _, test := range []struct {
+		navlang        string
+		acceptLanguage string
+		expected       string
+	}{
+		{"pt-BR", "", "pt"},
+		{"pt_BR", "", "pt"},
+		{"EN-us", "", "en"},
+		{"zh-Hant-TW", "", "zh"},
+		{"fr", "en-US,en;q=0.9", "fr"}, // navigator.language comes first
+		{"", "pt-BR,pt;q=0.9,en;q=0.8", "pt"},
+		{"", "de;q=0.8,en;q=0.5", "de"},
+		{"", " es ", "es"},
+		{"", "*", ""},
+		{"", "*;q=0.5", ""},
+		{"*", "en", ""},
+		{"", "", ""},
+		{"notalanguage", "", ""},
+	} {
+		if lang := primaryLanguage(test.navlang, test.acceptLanguage); lang != test.expected {
+			t.Errorf("primaryLanguage(%q, %q) = %q, expected %q",
+				test.navlang, test.acceptLanguage, lang, test.expected)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import "strings"
+
+// hostTrie stores hostnames by their labels in reverse order (com -> spam -> www),
+// so a lookup for "ru.spam.com" walks com, spam and stops as soon as it finds
+// "spam.com" was added. this means every entry also matches all its subdomains.
+// entries written as "*.spam.com" are treated just like "spam.com".
+// a bare top-level domain like "com" would then match everything under it,
+// so entries must have at least two labels.
+type hostTrie struct {
+	children map[string]*hostTrie
+	terminal bool
+}
+
+func newHostTrie() *hostTrie {
+	return &hostTrie{children: make(map[string]*hostTrie)}
+}
+
+// add returns false when the host was refused.
+func (t *hostTrie) add(host string) bool {
+	host = normalizeHost(strings.TrimPrefix(host, "*."))
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" {
+			return false
+		}
+	}
+
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = newHostTrie()
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	node.terminal = true
+	return true
+}
+
+func (t *hostTrie) matches(host string) bool {
+	host = normalizeHost(host)
+	if host == "" {
+		return false
+	}
+
+	node := t
+	labels := strings.Split(host, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			return false
+		}
+		if child.terminal {
+			return true
+		}
+		node = child
+	}
+	return false
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
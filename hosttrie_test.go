@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestHostTrie(t *testing.T) {
+	trie := newHostTrie()
+	for _, host := range []string{"spam.com", "*.wild.net", "dotted.org.", "UPPER.io", " spaced.co.uk "} {
+		if !trie.add(host) {
+			t.Errorf("add(%q) refused", host)
+		}
+	}
+
+	for host, expected := range map[string]bool{
+		"spam.com":         true,
+		"www.spam.com":     true,
+		"ru.www.spam.com":  true,
+		"SPAM.com":         true,
+		"spam.com.":        true,
+		"notspam.com":      false,
+		"spam.com.br":      false,
+		"com":              false,
+		"wild.net":         true,
+		"a.wild.net":       true,
+		"dotted.org":       true,
+		"x.dotted.org":     true,
+		"upper.io":         true,
+		"spaced.co.uk":     true,
+		"other.co.uk":      false,
+		"":                 false,
+		"google.com":       false,
+		"nothing.example.": false,
+	} {
+		if got := trie.matches(host); got != expected {
+			t.Errorf("matches(%q) = %v, expected %v", host, got, expected)
+		}
+	}
+}
+
+func TestHostTrieRefusesTopLevelDomains(t *testing.T) {
+	trie := newHostTrie()
+	for _, host := range []string{"com", "com.", "*.com", ".com", "spam..com", "", "."} {
+		if trie.add(host) {
+			t.Errorf("add(%q) should be refused", host)
+		}
+	}
+	if trie.matches("google.com") {
+		t.Error("a refused entry still matches")
+	}
+}
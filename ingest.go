@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// ingester takes hits from track() and writes them to redis in batches, in
+// the background, so slow writes don't make the tracker slow on our users'
+// pages. hits are sharded by session, so the events of a session are always
+// written by the same worker, in order.
+type ingester struct {
+	queues       []chan hit
+	wg           sync.WaitGroup
+	batchSize    int
+	interval     time.Duration
+	block        bool
+	blockTimeout time.Duration
+
+	dropped uint64 // hits refused because the queue was full
+
+	// hits track() refused are only counted, so they are added up here and
+	// written on the next tick instead of taking a place on the queues.
+	filteredMutex sync.Mutex
+	filtered      map[filteredKey]int64
+
+	// requests still running when we give up waiting for them on shutdown
+	// may try to enqueue after the queues are closed.
+	mutex  sync.RWMutex
+	closed bool
+}
+
+// nil when ingestion is synchronous (INGEST_QUEUE_SIZE=0).
+var ingestion *ingester
+
+// checkIngestSettings is called before starting the workers, as bad values
+// would only show up later (a zero INGEST_FLUSH_INTERVAL panics in the workers).
+func checkIngestSettings() error {
+	if s.IngestBatchSize <= 0 {
+		return fmt.Errorf("INGEST_BATCH_SIZE must be positive, got %d", s.IngestBatchSize)
+	}
+	if s.IngestFlushInterval <= 0 {
+		return fmt.Errorf("INGEST_FLUSH_INTERVAL must be positive, got %s", s.IngestFlushInterval)
+	}
+	switch strings.ToLower(s.IngestPolicy) {
+	case "drop":
+	case "block":
+		if s.IngestBlockTimeout <= 0 {
+			return fmt.Errorf("INGEST_BLOCK_TIMEOUT must be positive, got %s", s.IngestBlockTimeout)
+		}
+	default:
+		return fmt.Errorf("INGEST_POLICY must be drop or block, got %q", s.IngestPolicy)
+	}
+	return nil
+}
+
+func startIngestion() *ingester {
+	in := &ingester{
+		queues:       make([]chan hit, s.IngestWorkers),
+		batchSize:    s.IngestBatchSize,
+		interval:     s.IngestFlushInterval,
+		block:        strings.ToLower(s.IngestPolicy) == "block",
+		blockTimeout: s.IngestBlockTimeout,
+		filtered:     make(map[filteredKey]int64),
+	}
+
+	if err := trackScript.Load(rds).Err(); err != nil {
+		log.Warn().Err(err).Msg("failed to load track script on redis")
+	}
+	if err := rateLimitScript.Load(rds).Err(); err != nil {
+		log.Warn().Err(err).Msg("failed to load rate limit script on redis")
+	}
+
+	in.start(s.IngestQueueSize)
+
+	log.Info().Int("workers", s.IngestWorkers).Int("queue", s.IngestQueueSize).
+		Str("policy", s.IngestPolicy).Msg("started ingestion workers")
+	return in
+}
+
+// start creates the queues, splitting queueSize among them, and their workers.
+func (in *ingester) start(queueSize int) {
+	for i := range in.queues {
+		in.queues[i] = make(chan hit, queueSize/len(in.queues)+1)
+		in.wg.Add(1)
+		go in.work(in.queues[i])
+	}
+}
+
+// enqueue returns false when the hit was dropped.
+func (in *ingester) enqueue(h hit) bool {
+	in.mutex.RLock()
+	defer in.mutex.RUnlock()
+	if in.closed {
+		atomic.AddUint64(&in.dropped, 1)
+		return false
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(h.session))
+	queue := in.queues[hash.Sum32()%uint32(len(in.queues))]
+
+	select {
+	case queue <- h:
+		return true
+	default:
+	}
+
+	if in.block {
+		timer := time.NewTimer(in.blockTimeout)
+		defer timer.Stop()
+		select {
+		case queue <- h:
+			return true
+		case <-timer.C:
+		}
+	}
+
+	atomic.AddUint64(&in.dropped, 1)
+	return false
+}
+
+// stop waits until everything in the queues is written.
+// hits enqueued after this are dropped.
+func (in *ingester) stop() {
+	in.mutex.Lock()
+	in.closed = true
+	for _, queue := range in.queues {
+		close(queue)
+	}
+	in.mutex.Unlock()
+
+	in.wg.Wait()
+	in.flushFiltered()
+	log.Info().Uint64("dropped", atomic.LoadUint64(&in.dropped)).
+		Msg("ingestion queues drained")
+}
+
+func (in *ingester) work(queue chan hit) {
+	defer in.wg.Done()
+
+	ticker := time.NewTicker(in.interval)
+	defer ticker.Stop()
+
+	batch := make([]hit, 0, in.batchSize)
+	for {
+		select {
+		case h, ok := <-queue:
+			if !ok {
+				in.flush(batch)
+				return
+			}
+			batch = append(batch, h)
+			if len(batch) >= in.batchSize {
+				in.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				in.flush(batch)
+				batch = batch[:0]
+			}
+			in.flushFiltered()
+		}
+	}
+}
+
+func (in *ingester) flush(batch []hit) {
+	// hits over the rate limits are only dropped here, so checking them
+	// doesn't slow down track() either.
+	batch = rateLimitBatch(batch)
+	if len(batch) == 0 {
+		return
+	}
+
+	pipe := rds.Pipeline()
+	defer pipe.Close()
+
+	cmds := make([]*redis.Cmd, len(batch))
+	for i, h := range batch {
+		keys, args := h.scriptParams()
+		cmds[i] = trackScript.EvalSha(pipe, keys, args...)
+	}
+	pipe.Exec() // errors are checked for each command below
+
+	var stored []hit
+	for i, cmd := range cmds {
+		res, err := cmd.Result()
+		if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+			// redis was restarted or flushed, this will load the script again
+			var length int64
+			length, err = storeHit(batch[i])
+			res = length
+		}
+		if err != nil {
+			metrics.trackingErrors.inc("")
+			log.Warn().Err(err).Str("domain", batch[i].domain).Msg("error tracking")
+			continue
+		}
+		if length, _ := res.(int64); length > 0 {
+			recordStored(batch[i])
+			stored = append(stored, batch[i])
+		}
+	}
+
+	if len(stored) > 0 {
+		publishHits(stored)
+	}
+}
+
+func (in *ingester) countFiltered(domain, day, reason string) {
+	in.filteredMutex.Lock()
+	in.filtered[filteredKey{domain, day, reason}]++
+	in.filteredMutex.Unlock()
+}
+
+// flushFiltered writes the counts of refused hits added up since the last time.
+func (in *ingester) flushFiltered() {
+	in.filteredMutex.Lock()
+	counts := in.filtered
+	if len(counts) > 0 {
+		in.filtered = make(map[filteredKey]int64)
+	}
+	in.filteredMutex.Unlock()
+
+	if len(counts) > 0 {
+		writeFilteredCounts(counts)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lucsky/cuid"
+)
+
+func TestCheckIngestSettings(t *testing.T) {
+	defer func(old Settings) { s = old }(s)
+
+	for _, test := range []struct {
+		batchSize    int
+		interval     time.Duration
+		policy       string
+		blockTimeout time.Duration
+		ok           bool
+	}{
+		{100, 100 * time.Millisecond, "drop", 0, true},
+		{100, 100 * time.Millisecond, "Block", time.Second, true},
+		{100, 0, "drop", 0, false},
+		{100, -time.Second, "drop", 0, false},
+		{0, 100 * time.Millisecond, "drop", 0, false},
+		{100, 100 * time.Millisecond, "block", 0, false},
+		{100, 100 * time.Millisecond, "wait", time.Second, false},
+	} {
+		s.IngestBatchSize, s.IngestFlushInterval = test.batchSize, test.interval
+		s.IngestPolicy, s.IngestBlockTimeout = test.policy, test.blockTimeout
+		if err := checkIngestSettings(); (err == nil) != test.ok {
+			t.Errorf("%+v: checkIngestSettings() = %v, expected ok: %v", test, err, test.ok)
+		}
+	}
+}
+
+// without workers nothing leaves the queues, so they fill up.
+func TestIngesterDropPolicy(t *testing.T) {
+	in := &ingester{queues: []chan hit{make(chan hit, 2)}}
+
+	for i, expected := range []bool{true, true, false, false} {
+		if ok := in.enqueue(hit{session: cuid.New()}); ok != expected {
+			t.Errorf("enqueue %d = %v, expected %v", i, ok, expected)
+		}
+	}
+	if in.dropped != 2 {
+		t.Errorf("%d hits dropped, expected 2", in.dropped)
+	}
+}
+
+func TestIngesterBlockPolicy(t *testing.T) {
+	queue := make(chan hit, 1)
+	in := &ingester{queues: []chan hit{queue}, block: true, blockTimeout: 50 * time.Millisecond}
+	in.enqueue(hit{session: "a"})
+
+	// waits for a place on the queue
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-queue
+	}()
+	if !in.enqueue(hit{session: "b"}) {
+		t.Error("the hit should wait for a place on the queue")
+	}
+
+	// and gives up after INGEST_BLOCK_TIMEOUT
+	start := time.Now()
+	if in.enqueue(hit{session: "c"}) {
+		t.Error("the hit should be dropped when the queue stays full")
+	}
+	if waited := time.Since(start); waited < in.blockTimeout {
+		t.Errorf("dropped after %s, before the block timeout", waited)
+	}
+	if in.dropped != 1 {
+		t.Errorf("%d hits dropped, expected 1", in.dropped)
+	}
+}
+
+func TestIngesterStopDrains(t *testing.T) {
+	testRedis(t)
+	defer func(old Settings) { s = old }(s)
+	s.RateLimitIP, s.RateLimitDomain = 0, 0
+
+	domain := "ingester.invalid"
+	today := presentDay().Format(DATEFORMAT)
+	deleteDayFromRedis(domain, today)
+	defer deleteDayFromRedis(domain, today)
+
+	// nothing is written before stop(), as batches are never full and the
+	// ticker doesn't tick.
+	in := &ingester{
+		queues:    make([]chan hit, 3),
+		batchSize: 100,
+		interval:  time.Hour,
+		filtered:  make(map[filteredKey]int64),
+	}
+	in.start(30)
+
+	for i := 0; i < 10; i++ {
+		in.enqueue(hit{domain: domain, day: today, session: cuid.New(), newSession: true, event: "/"})
+	}
+	in.countFiltered(domain, today, "bots")
+	in.countFiltered(domain, today, "bots")
+	in.countFiltered(domain, today, "dnt")
+
+	in.stop()
+
+	stats, _, err := statsFromRedis(domain, today)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NSessions != 10 {
+		t.Errorf("%d sessions written after stop(), expected 10", stats.NSessions)
+	}
+	filtered, _ := rds.HGetAll(makeFilteredKey(domain, today)).Result()
+	if filtered["bots"] != "2" || filtered["dnt"] != "1" {
+		t.Errorf("filtered counts = %v, expected 2 bots and 1 dnt", filtered)
+	}
+
+	if in.enqueue(hit{domain: domain, day: today, session: cuid.New(), newSession: true, event: "/"}) {
+		t.Error("hits enqueued after stop() should be dropped")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/redis.v5"
+)
+
+// visitors seen in this window are considered active.
+const activeWindow = time.Minute * 5
+
+type liveHit struct {
+	Session  string `json:"session"` // not the real session id, just a hash of it
+	Page     string `json:"page,omitempty"`
+	Points   int    `json:"points,omitempty"`
+	Referrer string `json:"referrer"`
+	Time     int64  `json:"time"`
+}
+
+func makeLiveChannel(domain string) string { return "live:" + domain }
+func makeActiveKey(domain string) string   { return "active:" + domain }
+
+// publishHits is called after hits are stored.
+// it goes through redis so every server instance can send them to its listeners.
+func publishHits(hits []hit) {
+	pipe := rds.Pipeline()
+	defer pipe.Close()
+
+	now := time.Now().Unix()
+	for _, h := range hits {
+		sum := sha256.Sum256([]byte(h.session))
+		live := liveHit{
+			Session:  hex.EncodeToString(sum[:])[:12],
+			Referrer: h.referrer,
+			Time:     now,
+		}
+		switch v := h.event.(type) {
+		case string:
+			live.Page = v
+		case int:
+			live.Points = v
+		}
+
+		jsonlive, _ := json.Marshal(live)
+		pipe.Publish(makeLiveChannel(h.domain), string(jsonlive))
+		pipe.ZAdd(makeActiveKey(h.domain), redis.Z{Score: float64(now), Member: live.Session})
+		pipe.Expire(makeActiveKey(h.domain), activeWindow)
+	}
+
+	if _, err := pipe.Exec(); err != nil {
+		log.Warn().Err(err).Int("hits", len(hits)).Msg("failed to publish live hits")
+	}
+}
+
+// activeVisitors counts the sessions that had some activity in the last minutes.
+func activeVisitors(domain string) (int, error) {
+	since := strconv.FormatInt(time.Now().Add(-activeWindow).Unix(), 10)
+	rds.ZRemRangeByScore(makeActiveKey(domain), "-inf", "("+since)
+	n, err := rds.ZCount(makeActiveKey(domain), since, "+inf").Result()
+	return int(n), err
+}
+
+// handleLive streams hits for a domain as Server-Sent Events.
+// "hit" events carry a liveHit, "active" events the number of active visitors,
+// sent when the stream starts and then every few seconds.
+func handleLive(c *fasthttp.RequestCtx, domain string) {
+	pubsub, err := rds.Subscribe(makeLiveChannel(domain))
+	if err != nil {
+		c.Error("failed to subscribe: "+err.Error(), 500)
+		return
+	}
+
+	c.SetContentType("text/event-stream")
+	c.Response.Header.Set("Cache-Control", "no-cache")
+	c.Response.Header.Set("X-Accel-Buffering", "no")
+
+	c.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer pubsub.Close()
+
+		sendActive := func() error {
+			n, err := activeVisitors(domain)
+			if err != nil {
+				log.Warn().Err(err).Str("domain", domain).Msg("failed to count active visitors")
+				return nil
+			}
+			w.WriteString("event: active\ndata: " + strconv.Itoa(n) + "\n\n")
+			return w.Flush()
+		}
+
+		if err := sendActive(); err != nil {
+			return
+		}
+
+		for {
+			select {
+			case <-shuttingDown:
+				return
+			default:
+			}
+
+			msgi, err := pubsub.ReceiveTimeout(time.Second * 15)
+			if err != nil {
+				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+					// nothing happened, but this also tells us if the client is gone
+					if err := sendActive(); err != nil {
+						return
+					}
+					continue
+				}
+				log.Warn().Err(err).Str("domain", domain).Msg("live stream failed")
+				return
+			}
+
+			if msg, ok := msgi.(*redis.Message); ok {
+				w.WriteString("event: hit\ndata: " + msg.Payload + "\n\n")
+				if err := w.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	})
+}
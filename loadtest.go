@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lucsky/cuid"
+	"github.com/ogier/pflag"
+	"gopkg.in/redis.v5"
+)
+
+// loadtest measures how long it takes to write hits to redis, both with
+// storeHit and with the separate (pipelined) calls track() used to make, so
+// we can see the difference. it should be run against a local redis, as it writes (and
+// then deletes) a fake domain there.
+func loadtest() {
+	var nhits, concurrency, perSession int
+	var domain string
+	pflag.IntVar(&nhits, "hits", 10000, "how many hits to write in each round")
+	pflag.IntVar(&concurrency, "concurrency", 20, "how many hits to write at the same time")
+	pflag.IntVar(&perSession, "per-session", 4, "how many hits each session will have")
+	pflag.StringVar(&domain, "domain", "loadtest.invalid", "the fake domain to write hits to")
+	pflag.Parse()
+
+	today := presentDay().Format(DATEFORMAT)
+	defer deleteDayFromRedis(domain, today)
+
+	for _, round := range []struct {
+		name  string
+		write func(hit) error
+	}{
+		{"pipelined calls", storeHitPipelined},
+		{"script", func(h hit) error { _, err := storeHit(h); return err }},
+	} {
+		deleteDayFromRedis(domain, today)
+
+		hits := make(chan hit)
+		go func() {
+			for i := 0; i < nhits; i += perSession {
+				session := cuid.New()
+				for j := 0; j < perSession; j++ {
+					hits <- hit{
+						domain:     domain,
+						day:        today,
+						session:    session,
+						newSession: j == 0,
+						event:      "/page",
+						referrer:   "news.ycombinator.com/",
+						attrs:      map[string]string{"device": "desktop", "browser": "Firefox"},
+					}
+				}
+			}
+			close(hits)
+		}()
+
+		var mutex sync.Mutex
+		var wg sync.WaitGroup
+		var latencies []time.Duration
+		var nerrors int
+
+		start := time.Now()
+		for w := 0; w < concurrency; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for h := range hits {
+					t := time.Now()
+					err := round.write(h)
+					elapsed := time.Since(t)
+
+					mutex.Lock()
+					latencies = append(latencies, elapsed)
+					if err != nil {
+						nerrors++
+					}
+					mutex.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		total := time.Since(start)
+
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		percentile := func(p float64) time.Duration {
+			if len(latencies) == 0 {
+				return 0
+			}
+			return latencies[int(float64(len(latencies)-1)*p)]
+		}
+
+		log.Info().
+			Str("round", round.name).
+			Int("hits", len(latencies)).
+			Int("errors", nerrors).
+			Dur("total", total).
+			Float64("hits/s", float64(len(latencies))/total.Seconds()).
+			Dur("p50", percentile(0.5)).
+			Dur("p90", percentile(0.9)).
+			Dur("p99", percentile(0.99)).
+			Msg("loadtest round finished")
+	}
+}
+
+// storeHitPipelined writes a hit the way track() used to, with separate
+// commands, only to compare with storeHit. they are pipelined in two
+// round-trips, as what goes in the second depends on the length of the
+// session list.
+func storeHitPipelined(h hit) error {
+	sessionkey := h.sessionKey()
+
+	pipe := rds.Pipeline()
+	defer pipe.Close()
+	var push *redis.IntCmd
+	if h.newSession {
+		push = pipe.RPush(sessionkey, h.referrer, formatEvent(h.event))
+		pipe.HMSet(makeAttrsKey(sessionkey), h.attrs)
+		pipe.Expire(makeAttrsKey(sessionkey), redisExpireInterval)
+		if h.attrs["visitor"] != "" {
+			pipe.SAdd(makeVisitorsKey(h.domain, h.day), h.attrs["visitor"])
+			pipe.Expire(makeVisitorsKey(h.domain, h.day), redisExpireInterval)
+		}
+	} else {
+		push = pipe.RPushX(sessionkey, formatEvent(h.event))
+	}
+	pipe.Expire(sessionkey, redisExpireInterval)
+	pipe.SAdd("compile:"+h.day, h.domain)
+	pipe.Expire("compile:"+h.day, redisExpireInterval)
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+
+	length := push.Val()
+	if length == 0 {
+		return nil
+	}
+
+	statspipe := rds.Pipeline()
+	defer statspipe.Close()
+	statskey := makeStatsKey(h.domain, h.day)
+	if length == 2 {
+		statspipe.SAdd(makeIndexKey(h.domain, h.day), sessionkey)
+		statspipe.Expire(makeIndexKey(h.domain, h.day), redisExpireInterval)
+		statspipe.HIncrBy(statskey, "nsessions", 1)
+		statspipe.HIncrBy(statskey, "nbounces", 1)
+	} else if length == 3 {
+		// the loadtest only sends pageviews, so the first event was a bounce
+		statspipe.HIncrBy(statskey, "nbounces", -1)
+	}
+	statspipe.HIncrBy(statskey, "npageviews", 1)
+	statspipe.HIncrBy(statskey, "score", 1)
+	statspipe.Expire(statskey, redisExpireInterval)
+	_, err := statspipe.Exec()
+	return err
+}
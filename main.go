@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/kelseyhightower/envconfig"
@@ -16,14 +17,61 @@ type Settings struct {
 	RedisAddr     string `envconfig:"REDIS_ADDR" required:"true"`
 	RedisPassword string `envconfig:"REDIS_PASSWORD" required:"true"`
 	PostgresURL   string `envconfig:"DATABASE_URL" required:"true"`
+	FilterBots    bool   `envconfig:"FILTER_BOTS" default:"true"`
+	CountVisitors bool   `envconfig:"COUNT_VISITORS" default:"false"`
+
+	LogLevel  string `envconfig:"LOG_LEVEL" default:"info"`     // "debug", "info", "warn", ...
+	LogFormat string `envconfig:"LOG_FORMAT" default:"console"` // "console" or "json"
+	// only 1 in every TRACK_LOG_SAMPLE tracked hits is logged (warnings always are).
+	TrackLogSample uint64 `envconfig:"TRACK_LOG_SAMPLE" default:"100"`
+
+	ReadTimeout        time.Duration `envconfig:"READ_TIMEOUT" default:"10s"`
+	WriteTimeout       time.Duration `envconfig:"WRITE_TIMEOUT" default:"30s"`
+	LiveTimeout        time.Duration `envconfig:"LIVE_TIMEOUT" default:"10m"` // how long a /live/ stream lasts
+	MaxRequestBodySize int           `envconfig:"MAX_REQUEST_BODY_SIZE" default:"65536"`
+	MaxConcurrency     int           `envconfig:"MAX_CONCURRENCY" default:"10000"`
+	ShutdownTimeout    time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"20s"`
+
+	BlacklistRefresh     time.Duration `envconfig:"BLACKLIST_REFRESH" default:"24h"`
+	ReferrerRulesRefresh time.Duration `envconfig:"REFERRER_RULES_REFRESH" default:"5m"`
+	GeoIPDatabase        string        `envconfig:"GEOIP_DATABASE"`
+
+	// how many proxies in front of us append to X-Forwarded-For (see clientIP()).
+	// 0 means we're not behind a proxy.
+	TrustedProxies int `envconfig:"TRUSTED_PROXIES" default:"1"`
+
+	// hits per minute allowed from a single IP and to a single site (which
+	// can be changed per site on the `site_settings` table). 0 disables.
+	RateLimitIP         int           `envconfig:"RATE_LIMIT_IP" default:"120"`
+	RateBurstIP         int           `envconfig:"RATE_BURST_IP" default:"60"`
+	RateLimitDomain     int           `envconfig:"RATE_LIMIT_DOMAIN" default:"6000"`
+	RateBurstDomain     int           `envconfig:"RATE_BURST_DOMAIN" default:"1000"`
+	SiteSettingsRefresh time.Duration `envconfig:"SITE_SETTINGS_REFRESH" default:"5m"`
+
+	// enables the /admin/ endpoints, which must be called with
+	// "Authorization: Bearer <ADMIN_TOKEN>".
+	AdminToken string `envconfig:"ADMIN_TOKEN"`
+
+	// /readyz fails if the daily routine hasn't succeeded for this long. 0 disables.
+	ReadyMaxDailyAge time.Duration `envconfig:"READY_MAX_DAILY_AGE" default:"26h"`
+
+	// hits are written to redis in the background, in batches.
+	// when the queue is full they are dropped, or, with the "block" policy,
+	// track() waits a little for some space before dropping them.
+	// INGEST_QUEUE_SIZE=0 makes track() write hits to redis itself.
+	IngestQueueSize     int           `envconfig:"INGEST_QUEUE_SIZE" default:"10000"`
+	IngestWorkers       int           `envconfig:"INGEST_WORKERS" default:"4"`
+	IngestBatchSize     int           `envconfig:"INGEST_BATCH_SIZE" default:"100"`
+	IngestFlushInterval time.Duration `envconfig:"INGEST_FLUSH_INTERVAL" default:"100ms"`
+	IngestPolicy        string        `envconfig:"INGEST_POLICY" default:"drop"`
+	IngestBlockTimeout  time.Duration `envconfig:"INGEST_BLOCK_TIMEOUT" default:"1s"`
 }
 
 var err error
 var s Settings
 var pg *sqlx.DB
 var rds *redis.Client
-var log = zerolog.New(os.Stderr).Output(zerolog.ConsoleWriter{Out: os.Stderr})
-var blacklist map[string]bool
+var log = zerolog.New(os.Stderr)
 
 func main() {
 	err = envconfig.Process("", &s)
@@ -31,7 +79,20 @@ func main() {
 		log.Fatal().Err(err).Msg("couldn't process envconfig")
 	}
 
-	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	// logging
+	var level zerolog.Level
+	level, err = zerolog.ParseLevel(s.LogLevel)
+	if err != nil {
+		log.Fatal().Err(err).Str("level", s.LogLevel).Msg("invalid LOG_LEVEL")
+	}
+	zerolog.SetGlobalLevel(level)
+	switch s.LogFormat {
+	case "console":
+		log = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	case "json":
+	default:
+		log.Fatal().Str("format", s.LogFormat).Msg("invalid LOG_FORMAT, must be console or json")
+	}
 	log = log.With().Timestamp().Logger()
 
 	// redis
@@ -39,6 +100,7 @@ func main() {
 		Addr:     s.RedisAddr,
 		Password: s.RedisPassword,
 	})
+	instrumentRedis()
 
 	// postgres connection
 	pg, err = sqlx.Connect("postgres", s.PostgresURL)
@@ -46,10 +108,6 @@ func main() {
 		log.Fatal().Err(err).Msg("couldn't connect to postgres")
 	}
 
-	// referrer blacklist
-	blacklist = buildReferrerBlacklist()
-	log.Print("using referrer blacklist with ", len(blacklist), " entries.")
-
 	// run routines or start the server
 	if len(os.Args) == 1 {
 		runServer()
@@ -59,8 +117,18 @@ func main() {
 			daily()
 		case "monthly":
 			monthly()
+		case "purge-spam":
+			purgeSpam()
+		case "loadtest":
+			loadtest()
+		case "delete-domain":
+			deleteDomainCommand()
+		case "export-session":
+			sessionCommand(false)
+		case "delete-session":
+			sessionCommand(true)
 		default:
-			log.Print("couldn't find what to run for ", os.Args[1])
+			log.Error().Str("command", os.Args[1]).Msg("couldn't find what to run")
 		}
 	}
 }
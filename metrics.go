@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/redis.v5"
+)
+
+// a minimal implementation of the prometheus text format, enough for the
+// handful of counters and histograms we have.
+// see https://prometheus.io/docs/instrumenting/exposition_formats/
+
+type counterVec struct {
+	name, help, label string
+
+	mutex  sync.Mutex
+	values map[string]uint64
+}
+
+func newCounter(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]uint64)}
+}
+
+func (c *counterVec) inc(labelValue string) { c.add(labelValue, 1) }
+
+func (c *counterVec) add(labelValue string, n uint64) {
+	c.mutex.Lock()
+	c.values[labelValue] += n
+	c.mutex.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, lv := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, labels(c.label, lv), c.values[lv])
+	}
+}
+
+// durations, in seconds.
+var defaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogramVec struct {
+	name, help, label string
+
+	mutex  sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // one for each bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help, label string) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(labelValue string, value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	series, ok := h.series[labelValue]
+	if !ok {
+		series = &histogram{counts: make([]uint64, len(defaultBuckets))}
+		h.series[labelValue] = series
+	}
+	for i, le := range defaultBuckets {
+		if value <= le {
+			series.counts[i]++
+			break
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+// since is a shortcut for `defer h.since(label, time.Now())`.
+func (h *histogramVec) since(labelValue string, start time.Time) {
+	h.observe(labelValue, time.Since(start).Seconds())
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, lv := range keys {
+		series := h.series[lv]
+		var cumulative uint64
+		for i, le := range defaultBuckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				labels(h.label, lv, "le", strconv.FormatFloat(le, 'g', -1, 64)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels(h.label, lv, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, labels(h.label, lv), series.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels(h.label, lv), series.count)
+	}
+}
+
+// labels takes name/value pairs, skipping the ones with an empty name.
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i] != "" {
+			parts = append(parts, pairs[i]+"="+strconv.Quote(pairs[i+1]))
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var metrics = struct {
+	hitsTracked     *counterVec
+	sessionsCreated *counterVec
+	hitsFiltered    *counterVec
+	trackingErrors  *counterVec
+	queryDuration   *histogramVec
+	redisDuration   *histogramVec
+	pgDuration      *histogramVec
+}{
+	hitsTracked:     newCounter("tc_hits_tracked_total", "Hits stored on redis.", ""),
+	sessionsCreated: newCounter("tc_sessions_created_total", "Sessions started.", ""),
+	hitsFiltered:    newCounter("tc_hits_filtered_total", "Hits not tracked, by reason (blacklist, bots, ratelimit, dnt, optout or dropped).", "reason"),
+	trackingErrors:  newCounter("tc_tracking_errors_total", "Hits that failed to be stored.", ""),
+	queryDuration:   newHistogram("tc_query_duration_seconds", "Time spent answering /query/* requests, by kind.", "kind"),
+	redisDuration:   newHistogram("tc_redis_duration_seconds", "Latency of redis commands (not counting pipelines), by command.", "command"),
+	pgDuration:      newHistogram("tc_postgres_duration_seconds", "Latency of postgres queries, by query.", "query"),
+}
+
+// recordStored counts a hit that made it to redis.
+func recordStored(h hit) {
+	metrics.hitsTracked.inc("")
+	if h.newSession {
+		metrics.sessionsCreated.inc("")
+	}
+}
+
+// instrumentRedis makes every command sent by rds be timed.
+func instrumentRedis() {
+	rds.WrapProcess(func(process func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			defer metrics.redisDuration.since(cmd.Name(), time.Now())
+			return process(cmd)
+		}
+	})
+}
+
+// the routines run on their own processes (from cron or the heroku scheduler),
+// so they write how they went to redis and the server reads it from there.
+func makeRoutineKey(routine string) string { return "routines:" + routine }
+
+var routineNames = []string{"daily", "monthly"}
+
+// recordRoutine should be called at the end of a routine.
+func recordRoutine(routine string, start time.Time, ok bool) {
+	now := time.Now()
+	fields := map[string]string{
+		"last_run":      strconv.FormatInt(now.Unix(), 10),
+		"last_duration": strconv.FormatFloat(now.Sub(start).Seconds(), 'f', 3, 64),
+		"last_ok":       "0",
+	}
+	if ok {
+		fields["last_ok"] = "1"
+		fields["last_success"] = fields["last_run"]
+	}
+
+	pipe := rds.Pipeline()
+	defer pipe.Close()
+	pipe.HMSet(makeRoutineKey(routine), fields)
+	outcome := "failures"
+	if ok {
+		outcome = "successes"
+	}
+	pipe.HIncrBy(makeRoutineKey(routine), outcome, 1)
+	if _, err := pipe.Exec(); err != nil {
+		log.Warn().Err(err).Str("routine", routine).Msg("failed to record routine run")
+	}
+}
+
+func handleMetrics(c *fasthttp.RequestCtx) {
+	c.SetContentType("text/plain; version=0.0.4")
+	w := c.Response.BodyWriter()
+
+	metrics.hitsTracked.write(w)
+	metrics.sessionsCreated.write(w)
+
+	if ingestion != nil {
+		// these are counted by the ingester itself
+		metrics.hitsFiltered.mutex.Lock()
+		metrics.hitsFiltered.values["dropped"] = atomic.LoadUint64(&ingestion.dropped)
+		metrics.hitsFiltered.mutex.Unlock()
+	}
+	metrics.hitsFiltered.write(w)
+	metrics.trackingErrors.write(w)
+	metrics.queryDuration.write(w)
+	metrics.redisDuration.write(w)
+	metrics.pgDuration.write(w)
+
+	gauges := []struct{ name, field, help string }{
+		{"tc_routine_last_run_timestamp_seconds", "last_run", "When the routine last ran."},
+		{"tc_routine_last_success_timestamp_seconds", "last_success", "When the routine last ran without failures."},
+		{"tc_routine_last_duration_seconds", "last_duration", "How long the last run took."},
+		{"tc_routine_last_ok", "last_ok", "1 if the last run had no failures."},
+	}
+	routines := make(map[string]map[string]string)
+	for _, routine := range routineNames {
+		fields, err := rds.HGetAll(makeRoutineKey(routine)).Result()
+		if err != nil {
+			log.Warn().Err(err).Str("routine", routine).Msg("failed to read routine runs")
+		}
+		routines[routine] = fields
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, routine := range routineNames {
+			if v, ok := routines[routine][g.field]; ok {
+				fmt.Fprintf(w, "%s%s %s\n", g.name, labels("routine", routine), v)
+			}
+		}
+	}
+	fmt.Fprintf(w, "# HELP tc_routine_runs_total Routine runs, by outcome.\n# TYPE tc_routine_runs_total counter\n")
+	for _, routine := range routineNames {
+		for _, outcome := range []string{"successes", "failures"} {
+			if v, ok := routines[routine][outcome]; ok {
+				fmt.Fprintf(w, "tc_routine_runs_total%s %s\n",
+					labels("routine", routine, "outcome", outcome), v)
+			}
+		}
+	}
+}
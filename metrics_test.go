@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestUnknownQueryIsNotMeasured(t *testing.T) {
+	for _, path := range []string{"/query/nope", "/query/", "/query/days/../x"} {
+		var c fasthttp.RequestCtx
+		c.Request.SetBodyString(`{"domain": "x.invalid", "last": 7}`)
+		handleQuery(path, &c)
+
+		if status := c.Response.StatusCode(); status != 404 {
+			t.Errorf("%s: got status %d, expected 404", path, status)
+		}
+	}
+
+	metrics.queryDuration.mutex.Lock()
+	defer metrics.queryDuration.mutex.Unlock()
+	for kind := range metrics.queryDuration.series {
+		switch kind {
+		case "days", "months", "today", "segments":
+		default:
+			t.Errorf("query duration measured for %q", kind)
+		}
+	}
+}
@@ -6,6 +6,9 @@ CREATE TABLE days (
   PRIMARY KEY (domain, day)
 );
 
+-- for finding sessions by id (see findSession())
+CREATE INDEX days_sessions ON days USING gin (sessions jsonb_path_ops);
+
 CREATE TABLE months (
   domain text NOT NULL,
   month text NOT NULL, -- 200601
@@ -13,13 +16,45 @@ CREATE TABLE months (
   nsessions int NOT NULL,
   npageviews int NOT NULL,
   score int NOT NULL,
+  nvisitors int NOT NULL DEFAULT 0,
   top_referrers jsonb NOT NULL,
   top_referrers_scores jsonb NOT NULL,
   top_pages jsonb NOT NULL,
+  top_sources jsonb NOT NULL DEFAULT '{}',
+  top_channels jsonb NOT NULL DEFAULT '{}',
+  top_campaigns jsonb NOT NULL DEFAULT '{}',
+  top_campaign_sources jsonb NOT NULL DEFAULT '{}',
+  top_devices jsonb NOT NULL DEFAULT '{}',
+  top_browsers jsonb NOT NULL DEFAULT '{}',
+  top_systems jsonb NOT NULL DEFAULT '{}',
+  top_countries jsonb NOT NULL DEFAULT '{}',
+  top_screens jsonb NOT NULL DEFAULT '{}',
+  top_languages jsonb NOT NULL DEFAULT '{}',
 
   PRIMARY KEY (domain, month)
 );
 
+CREATE TABLE blacklist_cache (
+  singleton boolean PRIMARY KEY DEFAULT true CHECK (singleton),
+  hosts jsonb NOT NULL, -- ["spam.com", ...]
+  fetched_at timestamptz NOT NULL
+);
+
+CREATE TABLE referrer_rules (
+  domain text NOT NULL,
+  host text NOT NULL,
+  allow boolean NOT NULL, -- true: never block, false: always block
+
+  PRIMARY KEY (domain, host)
+);
+
+CREATE TABLE site_settings (
+  domain text PRIMARY KEY,
+  rate_limit int NOT NULL DEFAULT 0, -- hits per minute, 0 means the global default
+  rate_burst int NOT NULL DEFAULT 0,
+  privacy text NOT NULL DEFAULT 'ignore' -- for DNT and Sec-GPC: 'ignore', 'drop' or 'anonymous'
+);
+
 CREATE TABLE temp_migration (
   domain text,
   code text,
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// what to do with hits from visitors that ask not to be tracked, through the
+// DNT or Sec-GPC headers. set per site on `site_settings.privacy`.
+const (
+	privacyIgnore    = "ignore"    // track them like everybody else (the default)
+	privacyDrop      = "drop"      // don't track them, only count the hits
+	privacyAnonymous = "anonymous" // track them, but without anything about the visitor
+)
+
+const optoutCookie = "tc_optout"
+
+// privacySignal tells whether the browser asks not to be tracked.
+func privacySignal(c *fasthttp.RequestCtx) bool {
+	return string(c.Request.Header.Peek("DNT")) == "1" ||
+		string(c.Request.Header.Peek("Sec-GPC")) == "1"
+}
+
+// optedOut tells whether the visitor has been at /optout. the cookie is only
+// sent by trackers that make their requests with credentials.
+func optedOut(c *fasthttp.RequestCtx) bool {
+	return string(c.Request.Header.Cookie(optoutCookie)) == "1"
+}
+
+// handleOptout sets (or, with ?undo=1, removes) a cookie on our domain that
+// stops all tracking from this browser, on all sites.
+// sites can link to it from their privacy policies.
+func handleOptout(c *fasthttp.RequestCtx) {
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+
+	cookie.SetKey(optoutCookie)
+	cookie.SetPath("/")
+	cookie.SetHTTPOnly(true)
+	cookie.SetSecure(true)
+	cookie.SetSameSite(fasthttp.CookieSameSiteNoneMode) // it must be sent from other sites
+
+	message := "You won't be tracked by trackingco.de on any site anymore, as long as you keep this browser's cookies."
+	if string(c.QueryArgs().Peek("undo")) == "1" {
+		cookie.SetValue("")
+		cookie.SetExpire(fasthttp.CookieExpireDelete)
+		message = "You're not opted out anymore."
+	} else {
+		cookie.SetValue("1")
+		cookie.SetExpire(time.Now().AddDate(5, 0, 0))
+	}
+	c.Response.Header.SetCookie(cookie)
+
+	c.Response.Header.Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	c.SetContentType("text/html; charset=utf-8")
+	c.SetBodyString(`<!doctype html><meta charset="utf-8"><title>trackingco.de opt-out</title><p>` + message + `</p>`)
+}
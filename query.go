@@ -1,91 +1,456 @@
 package main
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Params struct {
-	Domain         string `json:"domain"`
-	Last           int    `json:"last"`
-	Limit          int    `json:"limit"`
-	MinScore       int    `json:"min_score"`
-	ReferrerFilter string `json:"referrer_filter"`
+	Domain string `json:"domain"`
+	Last   int    `json:"last"`
+	From   string `json:"from"`  // 20060102 (or 200601 for months), used instead of `last`
+	To     string `json:"to"`    // same, defaults to today (or to this month)
+	Limit  int    `json:"limit"` // max number of entries in each compendium table
+
+	// how to group the results: "day", "week", "month", "quarter" or "year".
+	// defaults to "day" on /query/days and to "month" on /query/months.
+	Granularity      string `json:"granularity"`
+	WeekStart        string `json:"week_start"`        // "monday" (the default), "sunday", ...
+	BucketCompendium bool   `json:"bucket_compendium"` // also return a compendium for each bucket
+
+	Filter
+	Segments []Segment `json:"segments"` // only for /query/segments
+	Compare  bool      `json:"compare"`  // also return the preceding period of the same length
+
+	// /query/today only returns a compendium when asked, as it must read
+	// every session of the day to build it.
+	Compendium bool `json:"compendium"`
 }
 
-func queryDays(params Params) (res interface{}, err error) {
-	var days []Day
+// validate checks the period asked, which is ignored by /query/today.
+func (params Params) validate(path string) error {
+	if path == "/query/today" {
+		return nil
+	}
+
+	layout := DATEFORMAT
+	if path == "/query/months" {
+		layout = MONTHFORMAT
+	}
+
+	for _, date := range []string{params.From, params.To} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse(layout, date); err != nil {
+			return fmt.Errorf("invalid date %s, expected format %s", date, layout)
+		}
+	}
+
+	if params.To != "" && params.From == "" {
+		return errors.New("got `to` without `from`")
+	}
+	if params.From != "" && params.To != "" && params.From > params.To {
+		return errors.New("`from` is after `to`")
+	}
+	if params.From == "" && params.Last <= 0 {
+		return errors.New("either `last` or `from` must be given")
+	}
+
+	switch params.Granularity {
+	case "", "month", "quarter", "year":
+	case "day", "week":
+		if path == "/query/months" {
+			return fmt.Errorf("granularity %s is not available for months", params.Granularity)
+		}
+	default:
+		return fmt.Errorf("unknown granularity %s", params.Granularity)
+	}
+	if _, ok := weekdays[strings.ToLower(params.WeekStart)]; params.WeekStart != "" && !ok {
+		return fmt.Errorf("unknown week_start %s", params.WeekStart)
+	}
+	return nil
+}
+
+// dayRange returns the first and last days (inclusive) of the period asked.
+// if `previous` is true, it returns the period of the same length that comes
+// right before it.
+func (params Params) dayRange(previous bool) (from, to string) {
+	var first, last time.Time
+	if params.From != "" {
+		first, _ = time.Parse(DATEFORMAT, params.From)
+		last = presentDay()
+		if params.To != "" {
+			last, _ = time.Parse(DATEFORMAT, params.To)
+		}
+	} else {
+		last = presentDay()
+		first = last.AddDate(0, 0, -(params.Last - 1))
+	}
+
+	if previous {
+		length := int(last.Sub(first).Hours()/24) + 1
+		last = first.AddDate(0, 0, -1)
+		first = last.AddDate(0, 0, -(length - 1))
+	}
+
+	return first.Format(DATEFORMAT), last.Format(DATEFORMAT)
+}
+
+// monthRange is the same as dayRange, but for months.
+func (params Params) monthRange(previous bool) (from, to string) {
+	today := presentDay()
+	thismonth := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	var first, last time.Time
+	if params.From != "" {
+		first, _ = time.Parse(MONTHFORMAT, params.From)
+		last = thismonth
+		if params.To != "" {
+			last, _ = time.Parse(MONTHFORMAT, params.To)
+		}
+	} else {
+		last = thismonth
+		first = last.AddDate(0, -(params.Last - 1), 0)
+	}
+
+	if previous {
+		length := (last.Year()*12 + int(last.Month())) - (first.Year()*12 + int(first.Month())) + 1
+		last = first.AddDate(0, -1, 0)
+		first = last.AddDate(0, -(length - 1), 0)
+	}
+
+	return first.Format(MONTHFORMAT), last.Format(MONTHFORMAT)
+}
+
+type Segment struct {
+	Name string `json:"name"`
+	Filter
+}
+
+// fetchDays reads the days in the requested period from postgres, with
+// their sessions already decoded and filtered.
+func fetchDays(params Params, previous bool) (days []Day, err error) {
+	from, to := params.dayRange(previous)
+	start := time.Now()
 	err = pg.Select(&days, `
 SELECT day, sessions FROM days
-WHERE domain = $1
-  AND day > to_char(now() - make_interval(days := $2), 'YYYYMMDD')
+WHERE domain = $1 AND day >= $2 AND day <= $3
 ORDER BY day
-    `, params.Domain, params.Last)
+    `, params.Domain, from, to)
+	metrics.pgDuration.since("days", start)
 	if err != nil {
 		return
 	}
 
-	stats := make([]Stats, len(days))
-	compendium := &Compendium{
-		TopPages:           make(map[string]int),
-		TopReferrers:       make(map[string]int),
-		TopReferrersScores: make(map[string]int),
-	}
-	daynames := make([]string, len(days))
-
 	for i := range days {
 		err = json.Unmarshal(days[i].RawSessions, &days[i].sessions)
 		if err != nil {
 			return
 		}
+		days[i].sessions = params.Filter.apply(days[i].sessions)
+	}
+	return
+}
+
+func queryDays(params Params) (res interface{}, err error) {
+	days, err := fetchDays(params, false)
+	if err != nil {
+		return
+	}
+
+	var daynames []string
+	var stats []Stats
+	var compendiums []Compendium
+	compendium := newCompendium()
+
+	var totals Stats
+	for _, day := range days {
+		name := params.bucket(day.Day)
+		if len(daynames) == 0 || daynames[len(daynames)-1] != name {
+			daynames = append(daynames, name)
+			stats = append(stats, Stats{})
+			if params.BucketCompendium {
+				compendiums = append(compendiums, *newCompendium())
+			}
+		}
 
-		daynames[i] = days[i].Day
-		stats[i] = days[i].stats()
+		daystats := day.stats()
+		stats[len(stats)-1].add(daystats)
+		totals.add(daystats)
 
-		for _, session := range days[i].sessions {
+		for _, session := range day.sessions {
 			compendium.apply(session)
+			if params.BucketCompendium {
+				compendiums[len(compendiums)-1].apply(session)
+			}
+		}
+	}
+
+	if params.Limit > 0 {
+		compendium.limit(params.Limit)
+		for i := range compendiums {
+			compendiums[i].limit(params.Limit)
 		}
 	}
 
+	var previous *Comparison
+	if params.Compare {
+		var prevdays []Day
+		prevdays, err = fetchDays(params, true)
+		if err != nil {
+			return
+		}
+
+		var prevtotals Stats
+		prevcompendium := newCompendium()
+		for _, day := range prevdays {
+			prevtotals.add(day.stats())
+			for _, session := range day.sessions {
+				prevcompendium.apply(session)
+			}
+		}
+		previous = compare(totals, prevtotals, compendium, prevcompendium)
+	}
+
 	return struct {
-		Days       []string   `json:"days"`
+		Days        []string     `json:"days"` // or the names of the buckets
+		Stats       []Stats      `json:"stats"`
+		Compendium  Compendium   `json:"compendium"`
+		Compendiums []Compendium `json:"compendiums,omitempty"` // one for each bucket
+		Previous    *Comparison  `json:"previous,omitempty"`
+	}{daynames, stats, *compendium, compendiums, previous}, nil
+}
+
+// querySegments is like queryDays, but returns the stats and the compendium
+// separately for each segment, so they can be compared side by side.
+func querySegments(params Params) (res interface{}, err error) {
+	days, err := fetchDays(params, false)
+	if err != nil {
+		return
+	}
+
+	type segmentResult struct {
+		Name       string     `json:"name"`
 		Stats      []Stats    `json:"stats"`
 		Compendium Compendium `json:"compendium"`
-	}{daynames, stats, *compendium}, nil
+	}
+
+	var daynames []string
+	bucketindex := make([]int, len(days))
+	for i, day := range days {
+		name := params.bucket(day.Day)
+		if len(daynames) == 0 || daynames[len(daynames)-1] != name {
+			daynames = append(daynames, name)
+		}
+		bucketindex[i] = len(daynames) - 1
+	}
+
+	segments := make([]segmentResult, len(params.Segments))
+	for j, segment := range params.Segments {
+		stats := make([]Stats, len(daynames))
+		compendium := newCompendium()
+
+		for i, day := range days {
+			day.sessions = segment.Filter.apply(day.sessions)
+			stats[bucketindex[i]].add(day.stats())
+
+			for _, session := range day.sessions {
+				compendium.apply(session)
+			}
+		}
+
+		if params.Limit > 0 {
+			compendium.limit(params.Limit)
+		}
+		segments[j] = segmentResult{segment.Name, stats, *compendium}
+	}
+
+	return struct {
+		Days     []string        `json:"days"`
+		Segments []segmentResult `json:"segments"`
+	}{daynames, segments}, nil
 }
 
 func queryMonths(params Params) (res interface{}, err error) {
-	var months []Month
+	months, err := fetchMonths(params, false)
+	if err != nil {
+		return
+	}
+	months = groupMonths(params, months)
+
+	var totals Stats
+	compendium := newCompendium()
+	for _, month := range months {
+		totals.add(month.Stats)
+		compendium.join(month.Compendium)
+	}
+
+	if params.Limit > 0 {
+		for i := range months {
+			months[i].limit(params.Limit)
+		}
+		compendium.limit(params.Limit)
+	}
+
+	var previous *Comparison
+	if params.Compare {
+		var prevmonths []Month
+		prevmonths, err = fetchMonths(params, true)
+		if err != nil {
+			return
+		}
+
+		var prevtotals Stats
+		prevcompendium := newCompendium()
+		for _, month := range prevmonths {
+			prevtotals.add(month.Stats)
+			prevcompendium.join(month.Compendium)
+		}
+		previous = compare(totals, prevtotals, compendium, prevcompendium)
+	}
+
+	return struct {
+		Months     []Month     `json:"months"`
+		Compendium Compendium  `json:"compendium"`
+		Previous   *Comparison `json:"previous,omitempty"`
+	}{months, *compendium, previous}, nil
+}
+
+// fetchMonths reads the months in the requested period.
+func fetchMonths(params Params, previous bool) (months []Month, err error) {
+	from, to := params.monthRange(previous)
+	if !params.Filter.empty() {
+		return fetchMonthsFromDays(params, from, to)
+	}
+
+	start := time.Now()
 	err = pg.Select(&months, `
 SELECT month,
-  nbounces, nsessions, npageviews, score,
+  nbounces, nsessions, npageviews, score, nvisitors,
   top_pages,
   top_referrers,
-  top_referrers_scores
+  top_referrers_scores,
+  top_sources,
+  top_channels,
+  top_campaigns,
+  top_campaign_sources,
+  top_devices,
+  top_browsers,
+  top_systems,
+  top_countries,
+  top_screens,
+  top_languages
 FROM months
-WHERE domain = $1
-  AND month > to_char(now() - make_interval(months := $2), 'YYYYMM')
+WHERE domain = $1 AND month >= $2 AND month <= $3
 ORDER BY month
-    `, params.Domain, params.Last)
+    `, params.Domain, from, to)
+	metrics.pgDuration.since("months", start)
 	if err != nil {
 		return
 	}
 
-	compendium := &Compendium{
-		TopPages:           make(map[string]int),
-		TopReferrers:       make(map[string]int),
-		TopReferrersScores: make(map[string]int),
-	}
 	for i := range months {
 		months[i].unmarshal()
-		compendium.join(months[i].Compendium)
 	}
+	return
+}
 
-	return struct {
-		Months     []Month    `json:"months"`
-		Compendium Compendium `json:"compendium"`
-	}{months, *compendium}, nil
+// months are stored already aggregated, so to filter sessions we must go back to
+// the days table, which means only the months for which we still have the raw
+// sessions (see deleteDaysOlderThan) will show up.
+func fetchMonthsFromDays(params Params, from, to string) (months []Month, err error) {
+	var days []Day
+	start := time.Now()
+	err = pg.Select(&days, `
+SELECT day, sessions FROM days
+WHERE domain = $1 AND day >= $2 AND day <= $3
+ORDER BY day
+    `, params.Domain, from+"01", to+"31")
+	metrics.pgDuration.since("months_from_days", start)
+	if err != nil {
+		return
+	}
+
+	for i := range days {
+		err = json.Unmarshal(days[i].RawSessions, &days[i].sessions)
+		if err != nil {
+			return
+		}
+		days[i].sessions = params.Filter.apply(days[i].sessions)
+
+		month := days[i].Day[:6]
+		if len(months) == 0 || months[len(months)-1].Month != month {
+			months = append(months, Month{Month: month, Compendium: *newCompendium()})
+		}
+		current := &months[len(months)-1]
+
+		current.Stats.add(days[i].stats())
+		for _, session := range days[i].sessions {
+			current.Compendium.apply(session)
+		}
+	}
+	return
 }
 
 func queryToday(params Params) (res interface{}, err error) {
 	today := presentDay().Format(DATEFORMAT)
-	day := dayFromRedis(params.Domain, today)
-	return day.stats(), nil
+
+	filtered, err := rds.HGetAll(makeFilteredKey(params.Domain, today)).Result()
+	if err != nil {
+		return
+	}
+	nbots, _ := strconv.Atoi(filtered["bots"])
+	nratelimited, _ := strconv.Atoi(filtered["ratelimit"])
+	ndnt, _ := strconv.Atoi(filtered["dnt"])
+	noptout, _ := strconv.Atoi(filtered["optout"])
+
+	active, err := activeVisitors(params.Domain)
+	if err != nil {
+		return
+	}
+
+	// the totals (and visitors) are kept updated by track(), so we only read
+	// all the sessions when they must be filtered or listed on the compendium. trackScript writes the totals along with the sessions,
+	// so without them there was nothing tracked today and nothing to read.
+	stats, ok, err := statsFromRedis(params.Domain, today)
+	if err != nil {
+		return
+	}
+
+	var compendium *Compendium
+	if params.Compendium {
+		compendium = newCompendium()
+	}
+	if ok && (!params.Filter.empty() || params.Compendium) {
+		day := dayFromRedis(params.Domain, today)
+		day.sessions = params.Filter.apply(day.sessions)
+
+		if !params.Filter.empty() {
+			stats = day.stats()
+		}
+
+		if params.Compendium {
+			for _, session := range day.sessions {
+				compendium.apply(session)
+			}
+			if params.Limit > 0 {
+				compendium.limit(params.Limit)
+			}
+		}
+	}
+
+	return struct {
+		Stats
+		NBots        int         `json:"bots"`        // hits filtered because they came from bots
+		NRateLimited int         `json:"ratelimited"` // hits dropped for being over the rate limits
+		NDNT         int         `json:"dnt"`         // hits dropped for DNT or Sec-GPC (see site_settings.privacy)
+		NOptOut      int         `json:"optout"`      // hits from visitors who opted out
+		Active       int         `json:"active"`      // visitors seen in the last 5 minutes
+		Compendium   *Compendium `json:"compendium,omitempty"`
+	}{stats, nbots, nratelimited, ndnt, noptout, active, compendium}, nil
 }
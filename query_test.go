@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/lucsky/cuid"
+)
+
+func TestParamsValidate(t *testing.T) {
+	for _, test := range []struct {
+		path   string
+		params Params
+		ok     bool
+	}{
+		{"/query/days", Params{Last: 7}, true},
+		{"/query/days", Params{From: "20170101"}, true},
+		{"/query/days", Params{From: "20170101", To: "20170131"}, true},
+		{"/query/days", Params{From: "20170101", To: "20170101"}, true},
+		{"/query/days", Params{}, false},
+		{"/query/days", Params{Last: -1}, false},
+		{"/query/days", Params{To: "20170131", Last: 7}, false},
+		{"/query/days", Params{From: "20170131", To: "20170101"}, false},
+		{"/query/days", Params{From: "201701"}, false},
+		{"/query/days", Params{From: "20171301"}, false},
+		{"/query/days", Params{Last: 7, Granularity: "week", WeekStart: "Sunday"}, true},
+		{"/query/days", Params{Last: 7, Granularity: "fortnight"}, false},
+		{"/query/days", Params{Last: 7, WeekStart: "someday"}, false},
+		{"/query/months", Params{From: "201701", To: "201712"}, true},
+		{"/query/months", Params{From: "20170101"}, false},
+		{"/query/months", Params{Last: 12, Granularity: "quarter"}, true},
+		{"/query/months", Params{Last: 12, Granularity: "day"}, false},
+		{"/query/today", Params{}, true},
+	} {
+		err := test.params.validate(test.path)
+		if (err == nil) != test.ok {
+			t.Errorf("%s %+v: validate() = %v, expected ok: %v", test.path, test.params, err, test.ok)
+		}
+	}
+}
+
+func TestDayRange(t *testing.T) {
+	today := presentDay()
+
+	for _, test := range []struct {
+		params       Params
+		previous     bool
+		expectedFrom string
+		expectedTo   string
+	}{
+		{Params{From: "20170110", To: "20170119"}, false, "20170110", "20170119"},
+		{Params{From: "20170110", To: "20170119"}, true, "20161231", "20170109"},
+		{Params{From: "20170301", To: "20170301"}, true, "20170228", "20170228"},
+		{Params{From: "20160301", To: "20160331"}, true, "20160130", "20160229"},
+		{Params{From: "20170110"}, false, "20170110", today.Format(DATEFORMAT)},
+		{Params{Last: 1}, false, today.Format(DATEFORMAT), today.Format(DATEFORMAT)},
+		{Params{Last: 7}, false, today.AddDate(0, 0, -6).Format(DATEFORMAT), today.Format(DATEFORMAT)},
+		{Params{Last: 7}, true, today.AddDate(0, 0, -13).Format(DATEFORMAT), today.AddDate(0, 0, -7).Format(DATEFORMAT)},
+	} {
+		from, to := test.params.dayRange(test.previous)
+		if from != test.expectedFrom || to != test.expectedTo {
+			t.Errorf("%+v (previous: %v): dayRange() = %s, %s, expected %s, %s",
+				test.params, test.previous, from, to, test.expectedFrom, test.expectedTo)
+		}
+	}
+}
+
+func TestMonthRange(t *testing.T) {
+	today := presentDay()
+	thismonth := today.AddDate(0, 0, 1-today.Day())
+
+	for _, test := range []struct {
+		params       Params
+		previous     bool
+		expectedFrom string
+		expectedTo   string
+	}{
+		{Params{From: "201701", To: "201703"}, false, "201701", "201703"},
+		{Params{From: "201701", To: "201703"}, true, "201610", "201612"},
+		{Params{From: "201601", To: "201612"}, true, "201501", "201512"},
+		{Params{From: "201701"}, false, "201701", thismonth.Format(MONTHFORMAT)},
+		{Params{Last: 1}, false, thismonth.Format(MONTHFORMAT), thismonth.Format(MONTHFORMAT)},
+		{Params{Last: 3}, true, thismonth.AddDate(0, -5, 0).Format(MONTHFORMAT), thismonth.AddDate(0, -3, 0).Format(MONTHFORMAT)},
+	} {
+		from, to := test.params.monthRange(test.previous)
+		if from != test.expectedFrom || to != test.expectedTo {
+			t.Errorf("%+v (previous: %v): monthRange() = %s, %s, expected %s, %s",
+				test.params, test.previous, from, to, test.expectedFrom, test.expectedTo)
+		}
+	}
+}
+
+func TestQueryToday(t *testing.T) {
+	testRedis(t)
+	domain := "querytoday.invalid"
+	today := presentDay().Format(DATEFORMAT)
+	deleteDayFromRedis(domain, today)
+	defer deleteDayFromRedis(domain, today)
+
+	// a session that isn't on the index (like the ones from before we kept
+	// it) isn't looked for on a quiet day.
+	stray := redisKeyFactory(domain, today)("cstray")
+	rds.RPush(stray, "t.co/", "/")
+	defer rds.Del(stray)
+
+	query := func() (result struct {
+		Stats
+		Compendium *Compendium `json:"compendium"`
+	}) {
+		res, err := queryToday(Params{Domain: domain, Compendium: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, _ := json.Marshal(res)
+		json.Unmarshal(j, &result)
+		return
+	}
+
+	result := query()
+	if result.Stats != (Stats{}) {
+		t.Errorf("stats on a quiet day = %+v, expected zero", result.Stats)
+	}
+	if result.Compendium == nil || len(result.Compendium.TopPages) != 0 {
+		t.Errorf("compendium on a quiet day = %+v, expected an empty one", result.Compendium)
+	}
+
+	a, b := cuid.New(), cuid.New()
+	for _, h := range []hit{
+		{session: a, newSession: true, event: "/"},
+		{session: b, newSession: true, event: "/"},
+		{session: a, event: "/pricing"},
+	} {
+		h.domain, h.day, h.referrer = domain, today, "t.co/"
+		if _, err := storeHit(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, reason := range []string{"bots", "dnt", "dnt", "optout", "ratelimit"} {
+		countFiltered(domain, today, reason)
+	}
+
+	res, err := queryToday(Params{Domain: domain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var filtered map[string]int
+	j, _ := json.Marshal(res)
+	json.Unmarshal(j, &filtered)
+	for reason, expected := range map[string]int{"bots": 1, "dnt": 2, "optout": 1, "ratelimited": 1} {
+		if filtered[reason] != expected {
+			t.Errorf("%s = %d, expected %d", reason, filtered[reason], expected)
+		}
+	}
+
+	result = query()
+	if expected := (Stats{NSessions: 2, NBounces: 1, NPageviews: 3, Score: 3}); result.Stats != expected {
+		t.Errorf("stats = %+v, expected %+v", result.Stats, expected)
+	}
+	if result.Compendium == nil || result.Compendium.TopPages["/"] != 2 {
+		t.Errorf("compendium = %+v, expected / visited twice", result.Compendium)
+	}
+}
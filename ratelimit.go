@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+func makeIPBucketKey(ip string) string         { return "ratelimit:ip:" + ip }
+func makeDomainBucketKey(domain string) string { return "ratelimit:domain:" + domain }
+
+// rateLimitScript checks a number of token buckets and takes a token from each
+// of them, but only if all have one to give, so a hit refused by one bucket
+// doesn't count against the others.
+// buckets are refilled continuously at `rate` tokens per minute up to `burst`.
+// returns 0 if the hit is allowed, or the index (starting at 1) of the
+// bucket that refused it.
+//
+// KEYS: buckets
+// ARGV: now (in milliseconds), then rate and burst for each bucket
+var rateLimitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local remaining = {}
+
+for i, key in ipairs(KEYS) do
+  local rate = tonumber(ARGV[i * 2])
+  local burst = tonumber(ARGV[i * 2 + 1])
+
+  local state = redis.call('HMGET', key, 'tokens', 'ts')
+  local tokens = tonumber(state[1]) or burst
+  local ts = tonumber(state[2]) or now
+  if now > ts then
+    tokens = math.min(burst, tokens + (now - ts) * rate / 60000)
+  end
+
+  if tokens < 1 then
+    return i
+  end
+  remaining[i] = tokens - 1
+end
+
+for i, key in ipairs(KEYS) do
+  local rate = tonumber(ARGV[i * 2])
+  local burst = tonumber(ARGV[i * 2 + 1])
+  redis.call('HMSET', key, 'tokens', tostring(remaining[i]), 'ts', now)
+  redis.call('PEXPIRE', key, math.ceil(burst / rate * 60000) + 1000)
+end
+return 0
+`)
+
+// rateLimitParams are the keys and arguments for rateLimitScript, and the
+// name of the limit each key stands for. no keys means no limits.
+func rateLimitParams(ip, domain string) (keys, limits []string, args []interface{}) {
+	add := func(key, name string, rate, burst int) {
+		if rate <= 0 {
+			return
+		}
+		if burst <= 0 {
+			burst = rate
+		}
+		keys = append(keys, key)
+		limits = append(limits, name)
+		args = append(args, rate, burst)
+	}
+
+	add(makeIPBucketKey(ip), "ip", s.RateLimitIP, s.RateBurstIP)
+	site := settingsFor(domain)
+	if site.RateLimit > 0 {
+		add(makeDomainBucketKey(domain), "domain", site.RateLimit, site.RateBurst)
+	} else {
+		add(makeDomainBucketKey(domain), "domain", s.RateLimitDomain, s.RateBurstDomain)
+	}
+
+	now := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	args = append([]interface{}{now}, args...)
+	return
+}
+
+// rateLimitResult reads what rateLimitScript returned.
+// if redis failed we let the hit through.
+func rateLimitResult(domain string, limits []string, res interface{}, err error) (allowed bool, limit string) {
+	if err != nil {
+		log.Warn().Err(err).Str("domain", domain).Msg("failed to check rate limits")
+		return true, ""
+	}
+	if refused, _ := res.(int64); refused > 0 && int(refused) <= len(limits) {
+		return false, limits[refused-1]
+	}
+	return true, ""
+}
+
+// rateLimit tells whether a hit from this ip to this domain is within the
+// limits. when it isn't, `limit` is "ip" or "domain".
+// only used when ingestion is synchronous, otherwise the ingestion workers
+// check the limits for a whole batch with rateLimitBatch (and track() checks
+// the per-IP limit in memory first, with rateLimitIPLocally).
+func rateLimit(ip net.IP, domain string) (allowed bool, limit string) {
+	keys, limits, args := rateLimitParams(ip.String(), domain)
+	if len(keys) == 0 {
+		return true, ""
+	}
+
+	res, err := rateLimitScript.Run(rds, keys, args...).Result()
+	return rateLimitResult(domain, limits, res, err)
+}
+
+// rateLimitBatch checks the rate limits for all hits in a single round-trip,
+// counts the ones refused and returns the others.
+func rateLimitBatch(batch []hit) []hit {
+	pipe := rds.Pipeline()
+	defer pipe.Close()
+
+	cmds := make([]*redis.Cmd, len(batch))
+	limits := make([][]string, len(batch))
+	for i, h := range batch {
+		var keys []string
+		var args []interface{}
+		keys, limits[i], args = rateLimitParams(h.ip, h.domain)
+		if len(keys) > 0 {
+			cmds[i] = rateLimitScript.EvalSha(pipe, keys, args...)
+		}
+	}
+	pipe.Exec() // errors are checked for each command below
+
+	var allowed []hit
+	for i, h := range batch {
+		if cmds[i] == nil {
+			allowed = append(allowed, h)
+			continue
+		}
+
+		res, err := cmds[i].Result()
+		if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+			// redis was restarted or flushed, this will load the script again
+			keys, _, args := rateLimitParams(h.ip, h.domain)
+			res, err = rateLimitScript.Run(rds, keys, args...).Result()
+		}
+		if ok, limit := rateLimitResult(h.domain, limits[i], res, err); !ok {
+			log.Debug().Str("domain", h.domain).Str("limit", limit).Msg("hit over rate limit")
+			countFiltered(h.domain, h.day, "ratelimit")
+			continue
+		}
+		allowed = append(allowed, h)
+	}
+
+	return allowed
+}
+
+// localBuckets are token buckets kept in memory, refilled like the ones of
+// rateLimitScript. with background ingestion, track() checks the per-IP limit
+// on them before queueing a hit, so a single client can't fill the queues
+// with hits the workers would refuse anyway. the buckets on redis, shared by
+// all instances, are still checked by the workers.
+type localBuckets struct {
+	mutex   sync.Mutex
+	buckets map[string]*localBucket
+	swept   time.Time
+}
+
+type localBucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+var ipBuckets = &localBuckets{buckets: make(map[string]*localBucket)}
+
+// take takes a token from the bucket of `key`, if there's one.
+func (lb *localBuckets) take(key string, rate, burst int, now time.Time) bool {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	// buckets that had time to fill up are the same as new ones, so we forget
+	// them from time to time.
+	full := time.Duration(float64(burst) / float64(rate) * float64(time.Minute))
+	if now.Sub(lb.swept) > time.Minute {
+		for k, b := range lb.buckets {
+			if now.Sub(b.ts) >= full {
+				delete(lb.buckets, k)
+			}
+		}
+		lb.swept = now
+	}
+
+	b, ok := lb.buckets[key]
+	if !ok {
+		b = &localBucket{tokens: float64(burst), ts: now}
+		lb.buckets[key] = b
+	}
+	if now.After(b.ts) {
+		b.tokens += now.Sub(b.ts).Minutes() * float64(rate)
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+		b.ts = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimitIPLocally checks RATE_LIMIT_IP on this instance only.
+func rateLimitIPLocally(ip net.IP) (allowed bool) {
+	if s.RateLimitIP <= 0 {
+		return true
+	}
+	burst := s.RateBurstIP
+	if burst <= 0 {
+		burst = s.RateLimitIP
+	}
+	return ipBuckets.take(ip.String(), s.RateLimitIP, burst, time.Now())
+}
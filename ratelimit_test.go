@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRateLimitScript(t *testing.T) {
+	testRedis(t)
+	small, big := makeIPBucketKey("192.0.2.1"), makeDomainBucketKey("ratelimit.invalid")
+	rds.Del(small, big)
+	defer rds.Del(small, big)
+
+	now := int64(1500000000000)
+	check := func(ms int64, keys ...string) int64 {
+		args := []interface{}{strconv.FormatInt(now+ms, 10)}
+		for _, key := range keys {
+			if key == small {
+				args = append(args, 60, 3) // a token per second, 3 at most
+			} else {
+				args = append(args, 60, 10)
+			}
+		}
+		refused, err := rateLimitScript.Run(rds, keys, args...).Int64()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return refused
+	}
+
+	for i := 0; i < 3; i++ {
+		if refused := check(0, small, big); refused != 0 {
+			t.Fatalf("hit %d refused by bucket %d within the burst", i, refused)
+		}
+	}
+	if refused := check(0, small, big); refused != 1 {
+		t.Errorf("hit over the burst: refused by %d, expected 1", refused)
+	}
+
+	// the refused hit didn't take a token from the other bucket
+	tokens, _ := rds.HGet(big, "tokens").Float64()
+	if tokens != 7 {
+		t.Errorf("the other bucket has %v tokens, expected 7", tokens)
+	}
+
+	// a second later there's a new token, but only one
+	if refused := check(1000, small, big); refused != 0 {
+		t.Errorf("hit after refill refused by %d", refused)
+	}
+	if refused := check(1000, small, big); refused != 1 {
+		t.Errorf("second hit after refill: refused by %d, expected 1", refused)
+	}
+
+	// the refill stops at the burst
+	for i := 0; i < 3; i++ {
+		if refused := check(60000, small); refused != 0 {
+			t.Fatalf("hit %d after a minute refused", i)
+		}
+	}
+	if refused := check(60000, small); refused != 1 {
+		t.Errorf("hit over the burst after a minute: refused by %d, expected 1", refused)
+	}
+
+	// and the second bucket refuses on its own
+	rds.Del(small)
+	for i := 0; i < 10; i++ {
+		check(60000, big)
+	}
+	if refused := check(60000, small, big); refused != 2 {
+		t.Errorf("hit with the second bucket empty: refused by %d, expected 2", refused)
+	}
+}
+
+func TestRateLimitBatch(t *testing.T) {
+	testRedis(t)
+	defer func(old Settings) { s = old }(s)
+	s.RateLimitIP, s.RateBurstIP = 60, 2
+	s.RateLimitDomain = 0
+
+	domain := "ratelimitbatch.invalid"
+	today := presentDay().Format(DATEFORMAT)
+	rds.Del(makeIPBucketKey("192.0.2.2"), makeIPBucketKey("192.0.2.3"), makeFilteredKey(domain, today))
+	defer rds.Del(makeIPBucketKey("192.0.2.2"), makeIPBucketKey("192.0.2.3"), makeFilteredKey(domain, today))
+
+	var batch []hit
+	for i := 0; i < 5; i++ {
+		batch = append(batch, hit{domain: domain, day: today, ip: "192.0.2.2", session: strconv.Itoa(i)})
+	}
+	batch = append(batch, hit{domain: domain, day: today, ip: "192.0.2.3", session: "other"})
+
+	allowed := rateLimitBatch(batch)
+	if len(allowed) != 3 {
+		t.Fatalf("%d hits allowed, expected 3", len(allowed))
+	}
+	if allowed[0].session != "0" || allowed[1].session != "1" || allowed[2].session != "other" {
+		t.Errorf("allowed the wrong hits: %+v", allowed)
+	}
+
+	if n, _ := rds.HGet(makeFilteredKey(domain, today), "ratelimit").Int64(); n != 3 {
+		t.Errorf("counted %d hits over the rate limit, expected 3", n)
+	}
+}
+
+func TestLocalBuckets(t *testing.T) {
+	lb := &localBuckets{buckets: make(map[string]*localBucket)}
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	take := func(key string, after time.Duration) bool {
+		return lb.take(key, 60, 3, now.Add(after)) // a token per second, 3 at most
+	}
+
+	for i := 0; i < 3; i++ {
+		if !take("a", 0) {
+			t.Fatalf("hit %d refused within the burst", i)
+		}
+	}
+	if take("a", 0) {
+		t.Error("hit over the burst allowed")
+	}
+	if !take("b", 0) {
+		t.Error("another key should have its own bucket")
+	}
+
+	// a second later there's a new token, but only one
+	if !take("a", time.Second) {
+		t.Error("hit after refill refused")
+	}
+	if take("a", time.Second) {
+		t.Error("second hit after refill allowed")
+	}
+
+	// the refill stops at the burst
+	for i := 0; i < 3; i++ {
+		if !take("a", time.Hour) {
+			t.Fatalf("hit %d after an hour refused", i)
+		}
+	}
+	if take("a", time.Hour) {
+		t.Error("hit over the burst after an hour allowed")
+	}
+
+	// and buckets that are full again are forgotten
+	if _, ok := lb.buckets["b"]; ok {
+		t.Error("the bucket for b should have been removed")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(old Settings) { s = old }(s)
+
+	for _, test := range []struct {
+		trustedProxies int
+		forwardedFor   []string
+		expected       string
+	}{
+		{0, nil, "10.0.0.1"},
+		{0, []string{"203.0.113.1"}, "10.0.0.1"},
+		{1, nil, "10.0.0.1"},
+		{1, []string{"203.0.113.1"}, "203.0.113.1"},
+		{1, []string{"198.51.100.7, 203.0.113.1"}, "203.0.113.1"}, // the first one is made up by the client
+		{2, []string{"198.51.100.7, 203.0.113.1"}, "198.51.100.7"},
+		{2, []string{"198.51.100.7", "203.0.113.1"}, "198.51.100.7"},
+		{2, []string{"203.0.113.1"}, "10.0.0.1"},
+		{1, []string{"garbage"}, "10.0.0.1"},
+	} {
+		s.TrustedProxies = test.trustedProxies
+
+		var c fasthttp.RequestCtx
+		c.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}, nil)
+		for _, value := range test.forwardedFor {
+			c.Request.Header.Add("X-Forwarded-For", value)
+		}
+
+		if ip := clientIP(&c); ip.String() != test.expected {
+			t.Errorf("%d proxies, X-Forwarded-For %v: clientIP() = %s, expected %s",
+				test.trustedProxies, test.forwardedFor, ip, test.expected)
+		}
+	}
+}
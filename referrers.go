@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// known referrers, checked in order, so more specific hosts must come first.
+// patterns ending in ".*" match any country TLD, like google.com.br or
+// google.co.uk. all patterns also match subdomains.
+var knownSources = []struct {
+	pattern string
+	name    string
+	channel string
+}{
+	// email
+	{"mail.google.com", "Gmail", "email"},
+	{"inbox.google.com", "Gmail", "email"},
+	{"mail.yahoo.*", "Yahoo! Mail", "email"},
+	{"mail.yandex.*", "Yandex Mail", "email"},
+	{"outlook.live.com", "Outlook", "email"},
+	{"outlook.office.com", "Outlook", "email"},
+	{"outlook.office365.com", "Outlook", "email"},
+	{"mail.proton.me", "Proton Mail", "email"},
+	{"mail.protonmail.com", "Proton Mail", "email"},
+	{"mail.zoho.com", "Zoho Mail", "email"},
+	{"mail.aol.com", "AOL Mail", "email"},
+	{"fastmail.com", "Fastmail", "email"},
+
+	// search
+	{"news.google.*", "Google News", "referral"},
+	{"google.*", "Google", "search"},
+	{"bing.com", "Bing", "search"},
+	{"duckduckgo.com", "DuckDuckGo", "search"},
+	{"search.yahoo.*", "Yahoo!", "search"},
+	{"yandex.*", "Yandex", "search"},
+	{"baidu.com", "Baidu", "search"},
+	{"ecosia.org", "Ecosia", "search"},
+	{"startpage.com", "Startpage", "search"},
+	{"qwant.com", "Qwant", "search"},
+	{"search.brave.com", "Brave Search", "search"},
+	{"ask.com", "Ask", "search"},
+	{"naver.com", "Naver", "search"},
+	{"seznam.cz", "Seznam", "search"},
+
+	// social
+	{"news.ycombinator.com", "Hacker News", "social"},
+	{"twitter.com", "Twitter", "social"},
+	{"t.co", "Twitter", "social"},
+	{"x.com", "Twitter", "social"},
+	{"facebook.com", "Facebook", "social"},
+	{"fb.me", "Facebook", "social"},
+	{"instagram.com", "Instagram", "social"},
+	{"linkedin.com", "LinkedIn", "social"},
+	{"lnkd.in", "LinkedIn", "social"},
+	{"reddit.com", "Reddit", "social"},
+	{"lobste.rs", "Lobsters", "social"},
+	{"youtube.com", "YouTube", "social"},
+	{"pinterest.*", "Pinterest", "social"},
+	{"tumblr.com", "Tumblr", "social"},
+	{"vk.com", "VK", "social"},
+	{"producthunt.com", "Product Hunt", "social"},
+	{"mastodon.social", "Mastodon", "social"},
+	{"bsky.app", "Bluesky", "social"},
+	{"t.me", "Telegram", "social"},
+	{"web.whatsapp.com", "WhatsApp", "social"},
+	{"quora.com", "Quora", "social"},
+	{"medium.com", "Medium", "social"},
+	{"github.com", "GitHub", "referral"},
+}
+
+// classifyReferrer takes a referrer as stored in sessions (see track()) and
+// returns a human name for its source (the hostname, for unknown referrers)
+// and the channel it belongs to: "search", "social", "email", "referral" or
+// "direct" (when there's no referrer). sessions that start from a landing page
+// with campaign parameters are later put on the "campaign" channel by track().
+func classifyReferrer(referrer string) (source, channel string) {
+	if referrer == "" {
+		return "", "direct"
+	}
+
+	host := strings.TrimPrefix(normalizeHost(referrerHost(referrer)), "www.")
+	for _, known := range knownSources {
+		if matchesSourcePattern(host, known.pattern) {
+			return known.name, known.channel
+		}
+	}
+
+	return host, "referral"
+}
+
+func matchesSourcePattern(host, pattern string) bool {
+	if !strings.HasSuffix(pattern, ".*") {
+		return host == pattern || strings.HasSuffix(host, "."+pattern)
+	}
+
+	// try the last one or two labels as the TLD ("com", "co.uk", "com.br").
+	// any label of up to 3 letters passes, so google.foo.io is Google too.
+	base := strings.TrimSuffix(pattern, ".*")
+	labels := strings.Split(host, ".")
+	for n := 1; n <= 2 && n < len(labels); n++ {
+		istld := true
+		for _, label := range labels[len(labels)-n:] {
+			if len(label) > 3 {
+				istld = false
+			}
+		}
+		if !istld {
+			continue
+		}
+
+		rest := strings.Join(labels[:len(labels)-n], ".")
+		if rest == base || strings.HasSuffix(rest, "."+base) {
+			return true
+		}
+	}
+	return false
+}
+
+// campaignFromQuery reads the utm_* parameters from the landing page querystring.
+// the "ref" parameter (as in ?ref=producthunt) is used when utm_source is missing.
+func campaignFromQuery(query url.Values) (source, medium, campaign string) {
+	source = strings.TrimSpace(query.Get("utm_source"))
+	if source == "" {
+		source = strings.TrimSpace(query.Get("ref"))
+	}
+	medium = strings.TrimSpace(query.Get("utm_medium"))
+	campaign = strings.TrimSpace(query.Get("utm_campaign"))
+	return
+}
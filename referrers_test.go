@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestClassifyReferrer(t *testing.T) {
+	for _, test := range []struct {
+		referrer string
+		source   string
+		channel  string
+	}{
+		{"", "", "direct"},
+		{"www.google.com/", "Google", "search"},
+		{"google.com.br/", "Google", "search"},
+		{"www.google.co.uk/search", "Google", "search"},
+		{"google.de/", "Google", "search"},
+		{"mail.google.com/mail/u/0", "Gmail", "email"},
+		{"news.google.com/articles/x", "Google News", "referral"},
+		{"news.google.com.br/", "Google News", "referral"},
+		{"t.co/abc", "Twitter", "social"},
+		{"x.com/someone/status/1", "Twitter", "social"},
+		{"mobile.twitter.com/", "Twitter", "social"},
+		{"news.ycombinator.com/item?{id}", "Hacker News", "social"},
+		{"mail.yahoo.co.jp/", "Yahoo! Mail", "email"},
+		{"search.yahoo.com/", "Yahoo!", "search"},
+		{"yandex.ru/", "Yandex", "search"},
+
+		// a host that only contains a known one isn't it
+		{"notgoogle.com/", "notgoogle.com", "referral"},
+		{"googleblog.com/", "googleblog.com", "referral"},
+		{"box.co/", "box.co", "referral"},
+		{"www.example.com/a", "example.com", "referral"},
+		{"google.example.com/", "google.example.com", "referral"},
+
+		// short labels are taken as TLDs, so these count as Google
+		{"google.foo.io/", "Google", "search"},
+		{"google.xyz/", "Google", "search"},
+	} {
+		source, channel := classifyReferrer(test.referrer)
+		if source != test.source || channel != test.channel {
+			t.Errorf("classifyReferrer(%q) = %q, %q, expected %q, %q",
+				test.referrer, source, channel, test.source, test.channel)
+		}
+	}
+}
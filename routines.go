@@ -1,9 +1,10 @@
 package main
 
 import (
-	"strconv"
+	"encoding/json"
 	"time"
 
+	"github.com/jmoiron/sqlx/types"
 	"github.com/ogier/pflag"
 )
 
@@ -14,18 +15,22 @@ func daily() {
 		"which day is today? (will compile for yesterday)")
 	pflag.Parse()
 
-	log.Print("# running daily routine for day ", day, ".")
+	log.Info().Str("day", day).Msg("running daily routine")
+	start := time.Now()
 
 	parsed, err := time.Parse(DATEFORMAT, day)
 	if err != nil {
-		log.Print("  # failed to parse day ", day)
+		log.Error().Err(err).Str("day", day).Msg("failed to parse day")
+		recordRoutine("daily", start, false)
 		return
 	}
 	yesterday := parsed.AddDate(0, 0, -1).Format(DATEFORMAT)
-	compileDayStats(yesterday)
+	failures := compileDayStats(yesterday)
 
 	moreThan90 := parsed.AddDate(0, -1, -90).Format(DATEFORMAT)
 	deleteDaysOlderThan(moreThan90)
+
+	recordRoutine("daily", start, failures == 0)
 }
 
 func monthly() {
@@ -35,37 +40,46 @@ func monthly() {
 		"which month are we in? (will compile for previous month)")
 	pflag.Parse()
 
-	log.Print("# running monthly routine for month ", month, ".")
+	log.Info().Str("month", month).Msg("running monthly routine")
+	start := time.Now()
 
 	parsed, err := time.Parse(MONTHFORMAT, month)
 	if err != nil {
-		log.Print("  # failed to parse month ", month)
+		log.Error().Err(err).Str("month", month).Msg("failed to parse month")
+		recordRoutine("monthly", start, false)
 		return
 	}
 	lastmonth := parsed.AddDate(0, -1, 0).Format(MONTHFORMAT)
-	compileMonthStats(lastmonth)
+	failures := compileMonthStats(lastmonth)
+
+	recordRoutine("monthly", start, failures == 0)
 }
 
-func compileDayStats(day string) {
-	log.Print("-- running compileDayStats routine for ", day, ".")
+// compileDayStats returns the number of sites that failed to be saved.
+func compileDayStats(day string) (failures int) {
+	log.Info().Str("day", day).Msg("compiling day stats")
 
 	domains, err := rds.SMembers("compile:" + day).Result()
 	if err != nil {
+		recordRoutine("daily", time.Now(), false)
 		log.Fatal().Err(err).Str("today", day).
 			Msg("error todays domains from redis.")
 	}
 
 	for _, domain := range domains {
-		log.Print("-------------")
-		log.Print(" > site ", domain)
+		logger := log.With().Str("domain", domain).Str("day", day).Logger()
 
 		// grab all data from redis
-		day := dayFromRedis(domain, day)
-		log.Print(day)
+		sessionkeys := sessionKeys(domain, day)
+		if len(sessionkeys) == 0 {
+			sessionkeys = scanSessionKeys(domain, day)
+		}
+		day := dayFromSessionKeys(domain, day, sessionkeys)
+		logger.Debug().Int("sessions", len(day.sessions)).Msg("read day from redis")
 
 		// check for zero-day (to save disk space we won't store these)
 		if len(day.RawSessions) < 3 {
-			log.Print("   : skipped saving because everything is zero.")
+			logger.Info().Msg("skipped saving because everything is zero")
 			continue
 		}
 
@@ -75,28 +89,37 @@ INSERT INTO days
   (domain, day, sessions)
 VALUES ($1, $2, $3)
         `, domain, day.Day, day.RawSessions); err != nil {
-			log.Print("   : failed to save day on postgres: ", err)
+			logger.Error().Err(err).Msg("failed to save day on postgres")
+			failures++
 			continue
 		}
-		log.Print("   : saved on postgres.")
+		logger.Info().Msg("saved on postgres")
 	}
+	return
 }
 
-func compileMonthStats(month string) {
-	log.Print("-- running compileMonthStats routine for ", month, ".")
+// compileMonthStats returns the number of sites that failed to be compiled.
+func compileMonthStats(month string) (failures int) {
+	log.Info().Str("month", month).Msg("compiling month stats")
 	monthstart := month + "01"
 	monthend := month + "31"
 
 	var domains []string
 	err := pg.Select(&domains, `SELECT DISTINCT domain FROM days`)
 	if err != nil {
+		recordRoutine("monthly", time.Now(), false)
 		log.Fatal().Err(err).Str("month", month).
 			Msg("error fetching domains from postgres.")
 	}
 
 	for _, domain := range domains {
-		log.Print("-------------")
-		log.Print(" > site ", domain)
+		logger := log.With().Str("domain", domain).Str("month", month).Logger()
+
+		if err := backfillSourcesAndChannels(domain, monthstart, monthend); err != nil {
+			logger.Error().Err(err).Msg("failed to classify the referrers of old sessions")
+			failures++
+			continue
+		}
 
 		_, err := pg.Exec(`
 WITH sessions AS (
@@ -115,6 +138,13 @@ WITH sessions AS (
   FROM sessions
   WHERE jsonb_array_length(session->'events') = 1
     AND (jsonb_typeof(session->'events'->0) = 'string' OR (session->'events'->0)::text::int = 1)
+), nvisitors AS (
+  SELECT coalesce(sum(count), 0) AS nvisitors FROM (
+    SELECT count(DISTINCT session->>'visitor')
+    FROM days, jsonb_array_elements(sessions) AS session
+    WHERE domain = $1 AND day >= $2 AND day <= $3
+    GROUP BY day
+  )x
 ), pages AS (
   SELECT event#>>'{}' AS page
   FROM events
@@ -148,48 +178,268 @@ WITH sessions AS (
     ORDER BY sum DESC
     LIMIT 10
   )x
+), top_sources AS (
+  SELECT jsonb_object_agg(source, count) AS top_sources FROM (
+    SELECT session->>'source' AS source, count(*)
+    FROM sessions
+    WHERE session->>'source' IS NOT NULL
+    GROUP BY source
+    ORDER BY count DESC
+    LIMIT 10
+  )x
+), top_channels AS (
+  SELECT jsonb_object_agg(channel, count) AS top_channels FROM (
+    SELECT session->>'channel' AS channel, count(*)
+    FROM sessions
+    WHERE session->>'channel' IS NOT NULL
+    GROUP BY channel
+    ORDER BY count DESC
+  )x
+), top_campaigns AS (
+  SELECT jsonb_object_agg(campaign, count) AS top_campaigns FROM (
+    SELECT session->>'utm_campaign' AS campaign, count(*)
+    FROM sessions
+    WHERE session->>'utm_campaign' IS NOT NULL
+    GROUP BY campaign
+    ORDER BY count DESC
+    LIMIT 10
+  )x
+), top_campaign_sources AS (
+  SELECT jsonb_object_agg(source, count) AS top_campaign_sources FROM (
+    SELECT session->>'utm_source' AS source, count(*)
+    FROM sessions
+    WHERE session->>'utm_source' IS NOT NULL
+    GROUP BY source
+    ORDER BY count DESC
+    LIMIT 10
+  )x
+), top_devices AS (
+  SELECT jsonb_object_agg(device, count) AS top_devices FROM (
+    SELECT session->>'device' AS device, count(*)
+    FROM sessions
+    WHERE session->>'device' IS NOT NULL
+    GROUP BY device
+    ORDER BY count DESC
+  )x
+), top_browsers AS (
+  SELECT jsonb_object_agg(browser, count) AS top_browsers FROM (
+    SELECT session->>'browser' AS browser, count(*)
+    FROM sessions
+    WHERE session->>'browser' IS NOT NULL
+    GROUP BY browser
+    ORDER BY count DESC
+    LIMIT 10
+  )x
+), top_systems AS (
+  SELECT jsonb_object_agg(os, count) AS top_systems FROM (
+    SELECT session->>'os' AS os, count(*)
+    FROM sessions
+    WHERE session->>'os' IS NOT NULL
+    GROUP BY os
+    ORDER BY count DESC
+    LIMIT 10
+  )x
+), top_countries AS (
+  SELECT jsonb_object_agg(country, count) AS top_countries FROM (
+    SELECT session->>'country' AS country, count(*)
+    FROM sessions
+    WHERE session->>'country' IS NOT NULL
+    GROUP BY country
+    ORDER BY count DESC
+    LIMIT 10
+  )x
+), top_screens AS (
+  SELECT jsonb_object_agg(screen, count) AS top_screens FROM (
+    SELECT session->>'screen' AS screen, count(*)
+    FROM sessions
+    WHERE session->>'screen' IS NOT NULL
+    GROUP BY screen
+    ORDER BY count DESC
+  )x
+), top_languages AS (
+  SELECT jsonb_object_agg(language, count) AS top_languages FROM (
+    SELECT session->>'language' AS language, count(*)
+    FROM sessions
+    WHERE session->>'language' IS NOT NULL
+    GROUP BY language
+    ORDER BY count DESC
+    LIMIT 10
+  )x
 ), agg AS (
   SELECT
     (SELECT score FROM score) AS score,
     (SELECT nbounces FROM nbounces) AS nbounces,
     (SELECT count(*) FROM sessions) AS nsessions,
     (SELECT count(*) FROM pages) AS npageviews,
+    (SELECT nvisitors FROM nvisitors) AS nvisitors,
     (SELECT coalesce(top_referrers, '{}') FROM top_referrers) AS top_referrers,
     (SELECT coalesce(top_referrers_scores, '{}') FROM top_referrers_scores) AS top_referrers_scores,
-    (SELECT coalesce(top_pages, '{}') FROM top_pages) AS top_pages
+    (SELECT coalesce(top_pages, '{}') FROM top_pages) AS top_pages,
+    (SELECT coalesce(top_sources, '{}') FROM top_sources) AS top_sources,
+    (SELECT coalesce(top_channels, '{}') FROM top_channels) AS top_channels,
+    (SELECT coalesce(top_campaigns, '{}') FROM top_campaigns) AS top_campaigns,
+    (SELECT coalesce(top_campaign_sources, '{}') FROM top_campaign_sources) AS top_campaign_sources,
+    (SELECT coalesce(top_devices, '{}') FROM top_devices) AS top_devices,
+    (SELECT coalesce(top_browsers, '{}') FROM top_browsers) AS top_browsers,
+    (SELECT coalesce(top_systems, '{}') FROM top_systems) AS top_systems,
+    (SELECT coalesce(top_countries, '{}') FROM top_countries) AS top_countries,
+    (SELECT coalesce(top_screens, '{}') FROM top_screens) AS top_screens,
+    (SELECT coalesce(top_languages, '{}') FROM top_languages) AS top_languages
 )
 
 INSERT INTO months
-  (domain, month, score, nbounces, nsessions, npageviews, top_referrers, top_referrers_scores, top_pages)
+  (domain, month, score, nbounces, nsessions, npageviews, nvisitors, top_referrers, top_referrers_scores, top_pages,
+   top_sources, top_channels, top_campaigns, top_campaign_sources,
+   top_devices, top_browsers, top_systems,
+   top_countries,
+   top_screens, top_languages)
   SELECT
-    $1, $4, score, nbounces, nsessions, npageviews, top_referrers, top_referrers_scores, top_pages
+    $1, $4, score, nbounces, nsessions, npageviews, nvisitors, top_referrers, top_referrers_scores, top_pages,
+    top_sources, top_channels, top_campaigns, top_campaign_sources,
+    top_devices, top_browsers, top_systems,
+    top_countries,
+    top_screens, top_languages
   FROM agg
         `, domain, monthstart, monthend, month)
 		if err != nil {
-			log.Print("   : failed to build monthly stats: ", err)
+			logger.Error().Err(err).Msg("failed to build monthly stats")
+			failures++
 			continue
 		}
-		log.Print("   : monthly stats built.")
+		logger.Info().Msg("monthly stats built")
+	}
+	return
+}
 
+// backfillSourcesAndChannels classifies the referrers of sessions stored
+// before track() did it (see sourceAndChannel()), so the monthly stats can
+// count them by source and channel like the daily ones do.
+func backfillSourcesAndChannels(domain, start, end string) error {
+	var days []Day
+	err := pg.Select(&days, `
+SELECT day, sessions FROM days
+WHERE domain = $1 AND day >= $2 AND day <= $3
+  AND EXISTS (
+    SELECT 1 FROM jsonb_array_elements(sessions) AS session
+    WHERE session->>'channel' IS NULL
+  )
+    `, domain, start, end)
+	if err != nil {
+		return err
 	}
+
+	for _, day := range days {
+		var sessions []Session
+		if err = day.RawSessions.Unmarshal(&sessions); err != nil {
+			return err
+		}
+		for i := range sessions {
+			sessions[i].Source, sessions[i].Channel = sessions[i].sourceAndChannel()
+		}
+		jsonsessions, err := json.Marshal(sessions)
+		if err != nil {
+			return err
+		}
+
+		if _, err = pg.Exec(`
+UPDATE days SET sessions = $3
+WHERE domain = $1 AND day = $2
+        `, domain, day.Day, types.JSONText(jsonsessions)); err != nil {
+			return err
+		}
+	}
+
+	if len(days) > 0 {
+		log.Info().Str("domain", domain).Int("days", len(days)).
+			Msg("classified the referrers of old sessions")
+	}
+	return nil
 }
 
 func deleteDaysOlderThan(dayInThePast string) {
-	log.Print("-- deleting days older than " + dayInThePast)
+	logger := log.With().Str("before", dayInThePast).Logger()
+	logger.Info().Msg("deleting old days")
 	r, err := pg.Exec(`
 DELETE FROM days
 WHERE day <= $1
     `, dayInThePast)
 	if err != nil {
-		log.Print("  : failed to delete old days: ", err)
+		logger.Error().Err(err).Msg("failed to delete old days")
 		return
 	}
 
 	rows, err := r.RowsAffected()
 	if err != nil {
-		log.Print("  : failed to get number of affected rows: ", err)
+		logger.Error().Err(err).Msg("failed to get number of affected rows")
 		return
 	}
 
-	log.Print("  : deleted " + strconv.Itoa(int(rows)) + " old days.")
+	logger.Info().Int64("deleted", rows).Msg("deleted old days")
+}
+
+func purgeSpam() {
+	var domain string
+	pflag.StringVar(&domain, "domain", "",
+		"purge only sessions from this site (default is all)")
+	pflag.Parse()
+
+	log.Info().Str("domain", domain).Msg("purging sessions with blacklisted referrers")
+	initReferrerBlacklist()
+	bl := currentBlacklist()
+
+	rows, err := pg.Queryx(`
+SELECT domain, day, sessions FROM days
+WHERE $1 = '' OR domain = $1
+ORDER BY domain, day
+    `, domain)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error fetching days from postgres.")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row struct {
+			Domain string `db:"domain"`
+			Day
+		}
+		if err := rows.StructScan(&row); err != nil {
+			log.Error().Err(err).Msg("failed to read day")
+			continue
+		}
+		if err := json.Unmarshal(row.RawSessions, &row.sessions); err != nil {
+			log.Error().Err(err).Str("domain", row.Domain).Str("day", row.Day.Day).
+				Msg("failed to parse sessions")
+			continue
+		}
+
+		var kept []Session
+		for _, session := range row.sessions {
+			if !bl.blocks(row.Domain, referrerHost(session.Referrer)) {
+				kept = append(kept, session)
+			}
+		}
+		if len(kept) == len(row.sessions) {
+			continue
+		}
+
+		rawsessions, _ := json.Marshal(kept)
+		if kept == nil {
+			rawsessions = []byte("[]")
+		}
+		if _, err = pg.Exec(`
+UPDATE days SET sessions = $3
+WHERE domain = $1 AND day = $2
+        `, row.Domain, row.Day.Day, types.JSONText(rawsessions)); err != nil {
+			log.Error().Err(err).Str("domain", row.Domain).Str("day", row.Day.Day).
+				Msg("failed to update day")
+			continue
+		}
+		log.Info().Str("domain", row.Domain).Str("day", row.Day.Day).
+			Int("removed", len(row.sessions)-len(kept)).Msg("removed spam sessions")
+	}
+	if err := rows.Err(); err != nil {
+		log.Error().Err(err).Msg("failed to iterate over days")
+	}
+
+	log.Info().Msg("done, months already compiled are not changed")
 }
@@ -4,17 +4,106 @@ import (
 	"context"
 	"encoding/json"
 	"mime"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/valyala/fasthttp"
 )
 
 func runServer() {
-	log.Print("listening at :" + s.Port)
-	panic(fasthttp.ListenAndServe(":"+s.Port, fastHTTPHandler))
+	// referrer blacklist
+	fetchedAt := initReferrerBlacklist()
+	go keepReferrerBlacklistFresh(fetchedAt, s.BlacklistRefresh)
+	go keepReferrerRulesFresh(s.ReferrerRulesRefresh)
+
+	// per-site settings
+	loadSiteSettings()
+	go keepSiteSettingsFresh(s.SiteSettingsRefresh)
+
+	// geolocation
+	if s.GeoIPDatabase != "" {
+		if geodb, err = openGeoDB(s.GeoIPDatabase); err != nil {
+			log.Fatal().Err(err).Str("path", s.GeoIPDatabase).
+				Msg("couldn't open geoip database")
+		}
+	}
+
+	// background ingestion
+	if s.IngestQueueSize > 0 && s.IngestWorkers > 0 {
+		if err := checkIngestSettings(); err != nil {
+			log.Fatal().Err(err).Msg("invalid ingestion settings")
+		}
+		ingestion = startIngestion()
+	}
+
+	server := &fasthttp.Server{
+		Handler:            fastHTTPHandler,
+		Name:               "trackingco.de",
+		ReadTimeout:        s.ReadTimeout,
+		WriteTimeout:       s.WriteTimeout,
+		MaxRequestBodySize: s.MaxRequestBodySize,
+		Concurrency:        s.MaxConcurrency,
+
+		// the whole /live/ stream is a single response, so it gets its own limit
+		HeaderReceived: func(header *fasthttp.RequestHeader) fasthttp.RequestConfig {
+			if strings.HasPrefix(string(header.RequestURI()), "/live/") {
+				return fasthttp.RequestConfig{WriteTimeout: s.LiveTimeout}
+			}
+			return fasthttp.RequestConfig{}
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Info().Str("signal", sig.String()).Msg("shutting down")
+
+		// stop accepting requests and wait for the ones in progress
+		close(shuttingDown)
+		finished := make(chan error, 1)
+		go func() { finished <- server.Shutdown() }()
+		gaveUp := false
+		select {
+		case err := <-finished:
+			if err != nil {
+				log.Warn().Err(err).Msg("error shutting down server")
+			}
+		case <-time.After(s.ShutdownTimeout):
+			log.Warn().Msg("gave up waiting for requests to finish")
+			gaveUp = true
+		}
+
+		// write what is still queued
+		if ingestion != nil {
+			ingestion.stop()
+		}
+
+		// requests still running would fail on closed connections, so if we
+		// didn't wait for them we leave it to the exit to close everything.
+		if !gaveUp {
+			rds.Close()
+			pg.Close()
+		}
+		close(done)
+	}()
+
+	log.Info().Str("port", s.Port).Msg("listening")
+	if err := server.ListenAndServe(":" + s.Port); err != nil {
+		log.Fatal().Err(err).Msg("server failed")
+	}
+	<-done
+	log.Info().Msg("bye")
 }
 
+// closed when the server starts shutting down.
+var shuttingDown = make(chan struct{})
+
 func fastHTTPHandler(c *fasthttp.RequestCtx) {
 	path := string(c.Path())
 
@@ -30,12 +119,30 @@ func fastHTTPHandler(c *fasthttp.RequestCtx) {
 		sendAsset(c, "static/landing.html")
 	case "/favicon.ico":
 		sendAsset(c, "static/logo.png")
+	case "/metrics":
+		handleMetrics(c)
+	case "/optout":
+		handleOptout(c)
+	case "/healthz":
+		handleHealthz(c)
+	case "/readyz":
+		handleReadyz(c)
 	default:
 		if strings.HasPrefix(path, "/query/") {
 			handleQuery(path, c)
 			return
 		}
 
+		if strings.HasPrefix(path, "/admin/") {
+			handleAdmin(c, path[len("/admin/"):])
+			return
+		}
+
+		if strings.HasPrefix(path, "/live/") {
+			handleLive(c, path[len("/live/"):])
+			return
+		}
+
 		if strings.HasPrefix(path, "/static/") {
 			sendAsset(c, path[1:])
 			return
@@ -56,14 +163,39 @@ func serveClient(c *fasthttp.RequestCtx) {
 
 func handleQuery(path string, c *fasthttp.RequestCtx) {
 	ctx := context.TODO()
+	start := time.Now()
+	kind := strings.TrimPrefix(path, "/query/")
+
+	// anything else would become a new series on the query metrics
+	switch kind {
+	case "days", "months", "today", "segments":
+	default:
+		c.Error("not found", 404)
+		return
+	}
+
+	logger := log.With().Str("request_id", requestID(c)).Str("query", kind).Logger()
 
 	var params Params
-	if err = json.Unmarshal(c.Request.Body(), &params); err != nil {
+	if err := json.Unmarshal(c.Request.Body(), &params); err != nil {
+		logger.Debug().Err(err).Msg("failed to read query")
 		c.Error("failed to read request: "+err.Error(), 400)
 		return
 	}
+	logger = logger.With().Str("domain", params.Domain).Logger()
+	if err := params.validate(path); err != nil {
+		logger.Debug().Err(err).Msg("invalid query")
+		c.Error("invalid query: "+err.Error(), 400)
+		return
+	}
+
+	defer func() {
+		metrics.queryDuration.since(kind, start)
+		logger.Debug().Dur("took", time.Since(start)).Msg("query")
+	}()
 
 	var result interface{}
+	var err error
 
 	switch path {
 	case "/query/days":
@@ -75,9 +207,13 @@ func handleQuery(path string, c *fasthttp.RequestCtx) {
 	case "/query/today":
 		result, err = queryToday(params)
 		break
+	case "/query/segments":
+		result, err = querySegments(params)
+		break
 	}
 
 	if err != nil {
+		logger.Warn().Err(err).Msg("query failure")
 		c.Error("query failure: "+err.Error(), 500)
 		return
 	}
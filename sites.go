@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SiteSettings are the per-site overrides kept on the `site_settings` table.
+// zero values mean "use the global default".
+type SiteSettings struct {
+	Domain    string `db:"domain"`
+	RateLimit int    `db:"rate_limit"` // hits per minute for the whole site
+	RateBurst int    `db:"rate_burst"`
+	Privacy   string `db:"privacy"` // how to treat DNT and Sec-GPC, see privacy.go
+}
+
+// holds a map[string]SiteSettings, swapped atomically on every refresh.
+var siteSettings atomic.Value
+
+func settingsFor(domain string) SiteSettings {
+	if all, ok := siteSettings.Load().(map[string]SiteSettings); ok {
+		if site, ok := all[domain]; ok {
+			return site
+		}
+	}
+	return SiteSettings{Domain: domain, Privacy: privacyIgnore}
+}
+
+func loadSiteSettings() {
+	var sites []SiteSettings
+	err := pg.Select(&sites, `SELECT domain, rate_limit, rate_burst, privacy FROM site_settings`)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load site settings.")
+		return
+	}
+
+	all := make(map[string]SiteSettings, len(sites))
+	for _, site := range sites {
+		all[site.Domain] = site
+	}
+	siteSettings.Store(all)
+}
+
+// keepSiteSettingsFresh should run in its own goroutine.
+func keepSiteSettingsFresh(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		loadSiteSettings()
+	}
+}
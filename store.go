@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strconv"
+
+	"gopkg.in/redis.v5"
+)
+
+// hit is everything track() needs to write for a single event.
+type hit struct {
+	domain     string
+	day        string
+	session    string // the cuid
+	newSession bool
+	event      interface{}
+	referrer   string
+	attrs      map[string]string // only for new sessions
+	ip         string            // only for the rate limits, never stored
+}
+
+func (h hit) sessionKey() string { return redisKeyFactory(h.domain, h.day)(h.session) }
+
+// trackScript does, atomically and in a single round-trip, all that used to be
+// done by track() in separate calls: push the event to the session list (or
+// create it), store the session attributes, add the session to the day index,
+// update the day totals and visitors and mark the domain to be compiled.
+// returns the length of the session list, 0 if the session didn't exist.
+//
+// KEYS: session list, session attributes, day index, day totals, compile set, day visitors
+// ARGV: ttl, domain, new session ("1" or "0"), event, referrer, attributes...
+var trackScript = redis.NewScript(`
+local ttl = tonumber(ARGV[1])
+local event = ARGV[4]
+
+local length
+if ARGV[3] == '1' then
+  length = redis.call('RPUSH', KEYS[1], ARGV[5], event)
+  if #ARGV > 5 then
+    redis.call('HMSET', KEYS[2], unpack(ARGV, 6))
+    redis.call('EXPIRE', KEYS[2], ttl)
+  end
+  for i = 6, #ARGV - 1, 2 do
+    if ARGV[i] == 'visitor' and ARGV[i + 1] ~= '' then
+      redis.call('SADD', KEYS[6], ARGV[i + 1])
+      redis.call('EXPIRE', KEYS[6], ttl)
+    end
+  end
+else
+  length = redis.call('RPUSHX', KEYS[1], event)
+  if length == 0 then
+    return 0
+  end
+end
+redis.call('EXPIRE', KEYS[1], ttl)
+
+redis.call('SADD', KEYS[5], ARGV[2])
+redis.call('EXPIRE', KEYS[5], ttl)
+
+-- pages are strings, points are numbers.
+-- a session with a single pageview or zero points is a bounce.
+local function isbounce (e)
+  local points = tonumber(e)
+  return points == nil or points == 0
+end
+
+if length == 2 then
+  redis.call('SADD', KEYS[3], KEYS[1])
+  redis.call('EXPIRE', KEYS[3], ttl)
+  redis.call('HINCRBY', KEYS[4], 'nsessions', 1)
+  if isbounce(event) then
+    redis.call('HINCRBY', KEYS[4], 'nbounces', 1)
+  end
+elseif length == 3 then
+  if isbounce(redis.call('LINDEX', KEYS[1], 1)) then
+    redis.call('HINCRBY', KEYS[4], 'nbounces', -1)
+  end
+end
+
+local points = tonumber(event)
+if points == nil then
+  redis.call('HINCRBY', KEYS[4], 'npageviews', 1)
+  redis.call('HINCRBY', KEYS[4], 'score', 1)
+else
+  redis.call('HINCRBY', KEYS[4], 'score', points)
+end
+redis.call('EXPIRE', KEYS[4], ttl)
+
+return length
+`)
+
+// storeHit writes a hit to redis. see trackScript.
+func storeHit(h hit) (length int64, err error) {
+	keys, args := h.scriptParams()
+	res, err := trackScript.Run(rds, keys, args...).Result()
+	if err != nil {
+		return 0, err
+	}
+	length, _ = res.(int64)
+	return length, nil
+}
+
+func (h hit) scriptParams() (keys []string, args []interface{}) {
+	sessionkey := h.sessionKey()
+	keys = []string{
+		sessionkey,
+		makeAttrsKey(sessionkey),
+		makeIndexKey(h.domain, h.day),
+		makeStatsKey(h.domain, h.day),
+		"compile:" + h.day,
+		makeVisitorsKey(h.domain, h.day),
+	}
+
+	newSession := "0"
+	if h.newSession {
+		newSession = "1"
+	}
+	args = []interface{}{
+		int64(redisExpireInterval.Seconds()),
+		h.domain,
+		newSession,
+		formatEvent(h.event),
+		h.referrer,
+	}
+	if h.newSession {
+		for k, v := range h.attrs {
+			args = append(args, k, v)
+		}
+	}
+	return
+}
+
+// formatEvent is the inverse of parseEvent.
+func formatEvent(event interface{}) string {
+	switch v := event.(type) {
+	case int:
+		return strconv.Itoa(v)
+	case string:
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/lucsky/cuid"
+	"gopkg.in/redis.v5"
+)
+
+// tests that need redis run against TEST_REDIS_ADDR, and are skipped when
+// it's not set. they write to fake domains, so don't point it to production.
+func testRedis(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR not set")
+	}
+	rds = redis.NewClient(&redis.Options{Addr: addr})
+	if err := rds.Ping().Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrackScriptCounters(t *testing.T) {
+	testRedis(t)
+	domain := "trackscript.invalid"
+	today := presentDay().Format(DATEFORMAT)
+	deleteDayFromRedis(domain, today)
+	defer deleteDayFromRedis(domain, today)
+
+	a, b, c, d, e := cuid.New(), cuid.New(), cuid.New(), cuid.New(), cuid.New()
+	for _, step := range []struct {
+		session    string
+		newSession bool
+		event      interface{}
+		length     int64
+	}{
+		{a, true, "/", 2},   // a bounce
+		{a, false, "/b", 3}, // not anymore
+		{b, true, 5, 2},     // points on the first event, not a bounce
+		{c, true, "/", 2},   // a bounce
+		{c, false, 0, 3},    // zero points still take it out of the bounces
+		{d, false, "/x", 0}, // expired (or never existed), ignored
+		{e, true, 0, 2},     // zero points, a bounce
+		{b, false, "/c", 3},
+	} {
+		length, err := storeHit(hit{
+			domain:     domain,
+			day:        today,
+			session:    step.session,
+			newSession: step.newSession,
+			event:      step.event,
+			referrer:   "news.ycombinator.com/",
+			attrs:      map[string]string{"device": "desktop"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if length != step.length {
+			t.Errorf("%v on %s: length = %d, expected %d", step.event, step.session, length, step.length)
+		}
+	}
+
+	stats, ok, err := statsFromRedis(domain, today)
+	if err != nil || !ok {
+		t.Fatalf("statsFromRedis() = %v, %v", ok, err)
+	}
+	expected := Stats{NSessions: 4, NBounces: 1, NPageviews: 4, Score: 9}
+	if stats != expected {
+		t.Errorf("counters = %+v, expected %+v", stats, expected)
+	}
+
+	// the counters must agree with the stats computed from the sessions
+	day := dayFromRedis(domain, today)
+	if computed := day.stats(); computed != stats {
+		t.Errorf("counters = %+v, but the sessions give %+v", stats, computed)
+	}
+	for _, session := range day.sessions {
+		if session.Device != "desktop" {
+			t.Errorf("session %s has no attributes", session.ID)
+		}
+	}
+
+	if ok, _ := rds.SIsMember("compile:"+today, domain).Result(); !ok {
+		t.Error("the domain wasn't marked to be compiled")
+	}
+	if err := deleteDayFromRedis(domain, today); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := rds.SIsMember("compile:"+today, domain).Result(); ok {
+		t.Error("the domain is still marked to be compiled after deleting the day")
+	}
+	if _, ok, _ := statsFromRedis(domain, today); ok {
+		t.Error("the counters are still there after deleting the day")
+	}
+}
+
+// the loadtest compares storeHit with storeHitPipelined, so they must
+// write the same thing.
+func TestStoreHitPipelined(t *testing.T) {
+	testRedis(t)
+	today := presentDay().Format(DATEFORMAT)
+
+	results := make(map[string]Stats)
+	for name, write := range map[string]func(hit) error{
+		"script.invalid":    func(h hit) error { _, err := storeHit(h); return err },
+		"pipelined.invalid": storeHitPipelined,
+	} {
+		deleteDayFromRedis(name, today)
+		defer deleteDayFromRedis(name, today)
+
+		a, b := cuid.New(), cuid.New()
+		for _, h := range []hit{
+			{session: a, newSession: true, event: "/"},
+			{session: b, newSession: true, event: "/"},
+			{session: a, event: "/b"},
+			{session: a, event: "/c"},
+		} {
+			h.domain, h.day = name, today
+			h.attrs = map[string]string{"device": "mobile", "visitor": h.session[:4]}
+			if err := write(h); err != nil {
+				t.Fatal(err)
+			}
+		}
+		results[name], _, _ = statsFromRedis(name, today)
+	}
+
+	if results["script.invalid"] != results["pipelined.invalid"] {
+		t.Errorf("storeHit wrote %+v, storeHitPipelined wrote %+v",
+			results["script.invalid"], results["pipelined.invalid"])
+	}
+}
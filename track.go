@@ -4,12 +4,21 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
-	"time"
+	"sync/atomic"
 
 	"github.com/lucsky/cuid"
+	"github.com/rs/zerolog"
 	"github.com/valyala/fasthttp"
 )
 
+var trackCount uint64
+
+// sampleTrackLog tells if this hit should be logged. there's one for each
+// pageview, so we only log 1 in every TRACK_LOG_SAMPLE.
+func sampleTrackLog() bool {
+	return s.TrackLogSample <= 1 || atomic.AddUint64(&trackCount, 1)%s.TrackLogSample == 0
+}
+
 func track(c *fasthttp.RequestCtx, session string) {
 	// cors
 	c.Response.Header.Add("Vary", "Origin")
@@ -17,6 +26,7 @@ func track(c *fasthttp.RequestCtx, session string) {
 	origin := c.Request.Header.Peek("Origin")
 	if len(origin) > 0 {
 		c.Response.Header.AddBytesV("Access-Control-Allow-Origin", origin)
+		c.Response.Header.Add("Access-Control-Allow-Credentials", "true") // for the opt-out cookie
 	} else {
 		c.Response.Header.Add("Access-Control-Allow-Origin", "*")
 	}
@@ -26,7 +36,10 @@ func track(c *fasthttp.RequestCtx, session string) {
 	c.Response.Header.Add("Pragma", "no-cache")
 	c.Response.Header.Add("Expires", "0")
 
-	logger := log.With().Logger()
+	logger := log.With().Str("request_id", requestID(c)).Logger()
+	if !sampleTrackLog() {
+		logger = logger.Level(zerolog.WarnLevel)
+	}
 
 	upage, err := url.Parse(string(c.Referer()))
 	if err != nil {
@@ -42,6 +55,10 @@ func track(c *fasthttp.RequestCtx, session string) {
 
 	// event
 	var event interface{}
+	var h hit
+	var anonymous bool
+	var isBot bool
+	var botReason string
 
 	if points, err := strconv.Atoi(string(c.FormValue("p"))); err != nil {
 		// if a call to tc() is made with no arguments,
@@ -67,9 +84,7 @@ func track(c *fasthttp.RequestCtx, session string) {
 	}
 
 	// plumbing
-	redisExpireInterval := time.Hour * 24 * 7
 	today := presentDay().Format(DATEFORMAT)
-	keyfn := redisKeyFactory(domain, today)
 
 	// referrer
 	referrer := string(c.FormValue("r")) // may be "". means <direct>.
@@ -77,8 +92,9 @@ func track(c *fasthttp.RequestCtx, session string) {
 		uref, err := url.Parse(referrer)
 		if err == nil {
 			// verify if referrer is on blacklist
-			if _, blacklisted := blacklist[uref.Host]; blacklisted {
-				log.Info().Str("ref", uref.Host).Msg("referrer on blacklist")
+			if currentBlacklist().blocks(domain, uref.Hostname()) {
+				logger.Info().Str("ref", uref.Host).Msg("referrer on blacklist")
+				metrics.hitsFiltered.inc("blacklist")
 
 				// send fake/invalid cuid to spammer
 				session = "z" + cuid.New()
@@ -97,30 +113,121 @@ func track(c *fasthttp.RequestCtx, session string) {
 		}
 	}
 
+	// privacy
+	if optedOut(c) {
+		logger.Debug().Msg("visitor opted out")
+		countFiltered(domain, today, "optout")
+
+		session = "z" + cuid.New()
+		goto end
+	}
+	if privacySignal(c) {
+		switch settingsFor(domain).Privacy {
+		case privacyDrop:
+			logger.Debug().Msg("visitor asked not to be tracked")
+			countFiltered(domain, today, "dnt")
+
+			session = "z" + cuid.New()
+			goto end
+		case privacyAnonymous:
+			anonymous = true
+		}
+	}
+
+	// bots (only tagged when FILTER_BOTS is off)
+	isBot, botReason = detectBot(c)
+	if isBot && s.FilterBots {
+		logger.Info().Str("reason", botReason).Msg("bot hit filtered")
+
+		// count it, so people can see how much noise was removed
+		countFiltered(domain, today, "bots")
+
+		session = "z" + cuid.New()
+		goto end
+	}
+
+	// rate limits (checked by the ingestion workers when there are any, but
+	// hits over the per-IP limit on this instance aren't even queued)
+	if ingestion == nil {
+		if allowed, limit := rateLimit(clientIP(c), domain); !allowed {
+			logger.Info().Str("limit", limit).Msg("hit over rate limit")
+			countFiltered(domain, today, "ratelimit")
+
+			session = "z" + cuid.New()
+			goto end
+		}
+	} else if !rateLimitIPLocally(clientIP(c)) {
+		logger.Info().Str("limit", "ip").Msg("hit over rate limit")
+		countFiltered(domain, today, "ratelimit")
+
+		session = "z" + cuid.New()
+		goto end
+	}
+
 	logger = logger.With().
 		Str("ref", referrer).
 		Str("session", session).Logger()
 
+	h = hit{
+		domain:   domain,
+		day:      today,
+		session:  session,
+		event:    event,
+		referrer: referrer,
+		ip:       clientIP(c).String(),
+	}
+
 	if session[0] != 'c' || strings.Index(session, "-") != -1 {
 		// not a valid cuid, means it's the first visit of session
 		// create session code
 		session = cuid.New()
-		// send the referrer first
-		err = rds.RPush(keyfn(session), referrer, event).Err()
-	} else {
-		err = rds.RPushX(keyfn(session), event).Err()
-	}
-
-	// expire session data
-	rds.Expire(keyfn(session), redisExpireInterval)
+		h.session = session
+		h.newSession = true
+
+		// the session attributes are stored in a separate hash
+		var attrs Session
+		attrs.Source, attrs.Channel = classifyReferrer(referrer)
+		attrs.CampaignSource, attrs.CampaignMedium, attrs.Campaign =
+			campaignFromQuery(upage.Query())
+		if attrs.CampaignSource != "" || attrs.CampaignMedium != "" || attrs.Campaign != "" {
+			attrs.Channel = "campaign"
+		}
+		if isBot {
+			attrs.Bot = botReason
+		}
 
-	// add this domain to the list of domains that should be compiled today
-	rds.SAdd("compile:"+today, domain)
-	rds.Expire("compile:"+today, redisExpireInterval)
+		// anything about the visitor is left out when they asked for it
+		if !anonymous {
+			attrs.Device, attrs.Browser, attrs.OS = parseUserAgent(string(c.UserAgent()))
+			if geodb != nil {
+				attrs.Country, attrs.Region = geodb.lookup(clientIP(c))
+			}
+			if s.CountVisitors {
+				attrs.Visitor, err = visitorID(domain, today, clientIP(c), string(c.UserAgent()))
+				if err != nil {
+					logger.Warn().Err(err).Msg("failed to identify visitor")
+				}
+			}
+			attrs.Screen = screenBucket(string(c.FormValue("w")))
+			attrs.Language = primaryLanguage(string(c.FormValue("l")),
+				string(c.Request.Header.Peek("Accept-Language")))
+		}
+		h.attrs = attrs.attributes()
+	}
 
-	if err != nil {
+	if ingestion != nil {
+		// will be written to redis in the background
+		if !ingestion.enqueue(h) {
+			logger.Warn().Msg("ingestion queue full, hit dropped")
+		}
+	} else if length, err := storeHit(h); err != nil {
+		metrics.trackingErrors.inc("")
 		logger.Warn().Err(err).Msg("error tracking")
 		c.Error("error tracking: "+err.Error(), 500)
+		return
+	} else if length > 0 {
+		recordStored(h)
+		publishHits([]hit{h})
 	}
 
 end:
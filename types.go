@@ -2,13 +2,114 @@ package main
 
 import (
 	"encoding/json"
+	"sort"
 
 	"github.com/jmoiron/sqlx/types"
 )
 
 type Session struct {
+	ID       string        `json:"id,omitempty"` // the cuid, missing on sessions compiled before we stored it
 	Referrer string        `json:"referrer"`
 	Events   []interface{} `json:"events"`
+
+	// attributes computed when the session starts (see track()).
+	// in redis these are kept in a hash alongside the session list.
+	Source  string `json:"source,omitempty"`  // "Google", "Hacker News", or the referrer hostname
+	Channel string `json:"channel,omitempty"` // "search", "social", "email", "referral", "campaign" or "direct"
+
+	// utm_* parameters (or ?ref=) from the landing page
+	CampaignSource string `json:"utm_source,omitempty"`
+	CampaignMedium string `json:"utm_medium,omitempty"`
+	Campaign       string `json:"utm_campaign,omitempty"`
+
+	// from the User-Agent
+	Device  string `json:"device,omitempty"`  // "desktop", "mobile" or "tablet"
+	Browser string `json:"browser,omitempty"` // "Chrome", "Firefox", "Safari", ...
+	OS      string `json:"os,omitempty"`      // "Windows", "Android", "iOS", ...
+
+	// from the visitor IP address (which is never stored)
+	Country string `json:"country,omitempty"` // ISO code, like "BR"
+	Region  string `json:"region,omitempty"`  // ISO code, like "BR-SP"
+
+	// from the browser window and settings
+	Screen   string `json:"screen,omitempty"`   // "mobile", "tablet" or "desktop", by viewport width
+	Language string `json:"language,omitempty"` // primary language subtag, like "en" or "pt"
+
+	// same for all sessions of a visitor in a day (see visitorID()).
+	// only when COUNT_VISITORS is enabled.
+	Visitor string `json:"visitor,omitempty"`
+
+	// why it looks like a bot (see detectBot()). only when FILTER_BOTS is
+	// disabled, otherwise these sessions aren't tracked at all.
+	Bot string `json:"bot,omitempty"`
+}
+
+func (s Session) attributes() map[string]string {
+	return map[string]string{
+		"source":       s.Source,
+		"channel":      s.Channel,
+		"utm_source":   s.CampaignSource,
+		"utm_medium":   s.CampaignMedium,
+		"utm_campaign": s.Campaign,
+		"device":       s.Device,
+		"browser":      s.Browser,
+		"os":           s.OS,
+		"country":      s.Country,
+		"region":       s.Region,
+		"screen":       s.Screen,
+		"language":     s.Language,
+		"visitor":      s.Visitor,
+		"bot":          s.Bot,
+	}
+}
+
+func (s *Session) setAttributes(attrs map[string]string) {
+	s.Source = attrs["source"]
+	s.Channel = attrs["channel"]
+	s.CampaignSource = attrs["utm_source"]
+	s.CampaignMedium = attrs["utm_medium"]
+	s.Campaign = attrs["utm_campaign"]
+	s.Device = attrs["device"]
+	s.Browser = attrs["browser"]
+	s.OS = attrs["os"]
+	s.Country = attrs["country"]
+	s.Region = attrs["region"]
+	s.Screen = attrs["screen"]
+	s.Language = attrs["language"]
+	s.Visitor = attrs["visitor"]
+	s.Bot = attrs["bot"]
+}
+
+// sessions stored before we started classifying referrers on track()
+// don't have these, so we derive them here.
+func (s Session) sourceAndChannel() (source, channel string) {
+	if s.Channel == "" {
+		return classifyReferrer(s.Referrer)
+	}
+	return s.Source, s.Channel
+}
+
+func (s Session) score() (score int) {
+	for _, event := range s.Events {
+		switch v := event.(type) {
+		case int:
+			score += v
+		case float64:
+			score += int(v)
+		case string:
+			score += 1
+		}
+	}
+	return
+}
+
+func (s Session) visited(page string) bool {
+	for _, event := range s.Events {
+		if v, ok := event.(string); ok && v == page {
+			return true
+		}
+	}
+	return false
 }
 
 type Day struct {
@@ -25,6 +126,7 @@ type Day struct {
 }
 
 func (day Day) stats() (stats Stats) {
+	stats.NVisitors = countVisitors(day.sessions)
 	for _, s := range day.sessions {
 		stats.NSessions++
 
@@ -32,6 +134,8 @@ func (day Day) stats() (stats Stats) {
 			switch v := event.(type) {
 			case int:
 				stats.Score += v
+			case float64: // sessions decoded from postgres
+				stats.Score += int(v)
 			case string:
 				stats.NPageviews++
 				stats.Score += 1
@@ -41,7 +145,8 @@ func (day Day) stats() (stats Stats) {
 		if len(s.Events) == 1 {
 			_, isPage := s.Events[0].(string)
 			points, isPoints := s.Events[0].(int)
-			if isPage || (isPoints && points == 0) {
+			fpoints, isFPoints := s.Events[0].(float64)
+			if isPage || (isPoints && points == 0) || (isFPoints && fpoints == 0) {
 				stats.NBounces++
 			}
 		}
@@ -61,16 +166,66 @@ type Stats struct {
 	NBounces   int `json:"b" db:"nbounces"`   // sessions with just one pageview
 	NPageviews int `json:"v" db:"npageviews"` // total number of pageviews
 	Score      int `json:"c" db:"score"`      // total score (sum of all session scores)
+
+	// unique visitors each day, summed over the period, since visitors can't be
+	// recognized from one day to the next.
+	NVisitors int `json:"i" db:"nvisitors"`
+}
+
+func (s *Stats) add(o Stats) {
+	s.NSessions += o.NSessions
+	s.NBounces += o.NBounces
+	s.NPageviews += o.NPageviews
+	s.Score += o.Score
+	s.NVisitors += o.NVisitors
 }
 
 type Compendium struct {
 	TopReferrers       map[string]int `json:"r"`
 	TopPages           map[string]int `json:"p"`
 	TopReferrersScores map[string]int `json:"z"`
+	TopSources         map[string]int `json:"o"`
+	TopChannels        map[string]int `json:"h"`
+	TopCampaigns       map[string]int `json:"m"` // by utm_campaign
+	TopCampaignSources map[string]int `json:"u"` // by utm_source
+	TopDevices         map[string]int `json:"d"`
+	TopBrowsers        map[string]int `json:"w"`
+	TopSystems         map[string]int `json:"x"`
+	TopCountries       map[string]int `json:"n"`
+	TopScreens         map[string]int `json:"k"`
+	TopLanguages       map[string]int `json:"l"`
 
 	RawTopReferrers       types.JSONText `json:"-" db:"top_referrers"`
 	RawTopPages           types.JSONText `json:"-" db:"top_pages"`
 	RawTopReferrersScores types.JSONText `json:"-" db:"top_referrers_scores"`
+	RawTopSources         types.JSONText `json:"-" db:"top_sources"`
+	RawTopChannels        types.JSONText `json:"-" db:"top_channels"`
+	RawTopCampaigns       types.JSONText `json:"-" db:"top_campaigns"`
+	RawTopCampaignSources types.JSONText `json:"-" db:"top_campaign_sources"`
+	RawTopDevices         types.JSONText `json:"-" db:"top_devices"`
+	RawTopBrowsers        types.JSONText `json:"-" db:"top_browsers"`
+	RawTopSystems         types.JSONText `json:"-" db:"top_systems"`
+	RawTopCountries       types.JSONText `json:"-" db:"top_countries"`
+	RawTopScreens         types.JSONText `json:"-" db:"top_screens"`
+	RawTopLanguages       types.JSONText `json:"-" db:"top_languages"`
+}
+
+func newCompendium() *Compendium {
+	return &Compendium{
+		TopPages:           make(map[string]int),
+		TopReferrers:       make(map[string]int),
+		TopReferrersScores: make(map[string]int),
+		TopSources:         make(map[string]int),
+		TopChannels:        make(map[string]int),
+		TopCampaigns:       make(map[string]int),
+		TopCampaignSources: make(map[string]int),
+		TopDevices:         make(map[string]int),
+		TopBrowsers:        make(map[string]int),
+		TopSystems:         make(map[string]int),
+		TopCountries:       make(map[string]int),
+		TopScreens:         make(map[string]int),
+		TopLanguages:       make(map[string]int),
+	}
 }
 
 func (c *Compendium) apply(session Session) {
@@ -82,6 +237,8 @@ func (c *Compendium) apply(session Session) {
 		switch v := event.(type) {
 		case int:
 			scores += v
+		case float64:
+			scores += int(v)
 		case string:
 			scores += 1
 
@@ -90,6 +247,40 @@ func (c *Compendium) apply(session Session) {
 		}
 	}
 	c.TopReferrersScores[session.Referrer] = scores
+
+	source, channel := session.sourceAndChannel()
+	if source != "" {
+		c.TopSources[source]++
+	}
+	c.TopChannels[channel]++
+
+	if session.Campaign != "" {
+		c.TopCampaigns[session.Campaign]++
+	}
+	if session.CampaignSource != "" {
+		c.TopCampaignSources[session.CampaignSource]++
+	}
+
+	if session.Device != "" {
+		c.TopDevices[session.Device]++
+	}
+	if session.Browser != "" {
+		c.TopBrowsers[session.Browser]++
+	}
+	if session.OS != "" {
+		c.TopSystems[session.OS]++
+	}
+
+	if session.Country != "" {
+		c.TopCountries[session.Country]++
+	}
+
+	if session.Screen != "" {
+		c.TopScreens[session.Screen]++
+	}
+	if session.Language != "" {
+		c.TopLanguages[session.Language]++
+	}
 }
 
 func (c *Compendium) join(cc Compendium) {
@@ -105,10 +296,101 @@ func (c *Compendium) join(cc Compendium) {
 		prev := c.TopReferrersScores[k]
 		c.TopReferrersScores[k] = prev + v
 	}
+	for k, v := range cc.TopSources {
+		prev := c.TopSources[k]
+		c.TopSources[k] = prev + v
+	}
+	for k, v := range cc.TopChannels {
+		prev := c.TopChannels[k]
+		c.TopChannels[k] = prev + v
+	}
+	for k, v := range cc.TopCampaigns {
+		prev := c.TopCampaigns[k]
+		c.TopCampaigns[k] = prev + v
+	}
+	for k, v := range cc.TopCampaignSources {
+		prev := c.TopCampaignSources[k]
+		c.TopCampaignSources[k] = prev + v
+	}
+	for k, v := range cc.TopDevices {
+		prev := c.TopDevices[k]
+		c.TopDevices[k] = prev + v
+	}
+	for k, v := range cc.TopBrowsers {
+		prev := c.TopBrowsers[k]
+		c.TopBrowsers[k] = prev + v
+	}
+	for k, v := range cc.TopSystems {
+		prev := c.TopSystems[k]
+		c.TopSystems[k] = prev + v
+	}
+	for k, v := range cc.TopCountries {
+		prev := c.TopCountries[k]
+		c.TopCountries[k] = prev + v
+	}
+	for k, v := range cc.TopScreens {
+		prev := c.TopScreens[k]
+		c.TopScreens[k] = prev + v
+	}
+	for k, v := range cc.TopLanguages {
+		prev := c.TopLanguages[k]
+		c.TopLanguages[k] = prev + v
+	}
+}
+
+func (c *Compendium) tables() []*map[string]int {
+	return []*map[string]int{
+		&c.TopReferrers,
+		&c.TopPages,
+		&c.TopReferrersScores,
+		&c.TopSources,
+		&c.TopChannels,
+		&c.TopCampaigns,
+		&c.TopCampaignSources,
+		&c.TopDevices,
+		&c.TopBrowsers,
+		&c.TopSystems,
+		&c.TopCountries,
+		&c.TopScreens,
+		&c.TopLanguages,
+	}
+}
+
+// limit keeps only the `n` biggest entries on each table.
+func (c *Compendium) limit(n int) {
+	for _, table := range c.tables() {
+		if len(*table) <= n {
+			continue
+		}
+
+		keys := make([]string, 0, len(*table))
+		for k := range *table {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return (*table)[keys[i]] > (*table)[keys[j]]
+		})
+
+		top := make(map[string]int, n)
+		for _, k := range keys[:n] {
+			top[k] = (*table)[k]
+		}
+		*table = top
+	}
 }
 
 func (c *Compendium) unmarshal() {
 	json.Unmarshal(c.RawTopPages, &c.TopPages)
 	json.Unmarshal(c.RawTopReferrers, &c.TopReferrers)
 	json.Unmarshal(c.RawTopReferrersScores, &c.TopReferrersScores)
+	json.Unmarshal(c.RawTopSources, &c.TopSources)
+	json.Unmarshal(c.RawTopChannels, &c.TopChannels)
+	json.Unmarshal(c.RawTopCampaigns, &c.TopCampaigns)
+	json.Unmarshal(c.RawTopCampaignSources, &c.TopCampaignSources)
+	json.Unmarshal(c.RawTopDevices, &c.TopDevices)
+	json.Unmarshal(c.RawTopBrowsers, &c.TopBrowsers)
+	json.Unmarshal(c.RawTopSystems, &c.TopSystems)
+	json.Unmarshal(c.RawTopCountries, &c.TopCountries)
+	json.Unmarshal(c.RawTopScreens, &c.TopScreens)
+	json.Unmarshal(c.RawTopLanguages, &c.TopLanguages)
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// the same sessions, as read from redis (points are ints) and as decoded from
+// the json stored on postgres (points are float64).
+const testSessionsJSON = `[
+  {"referrer": "https://a.com/", "events": ["/", 5, "/b"]},
+  {"referrer": "", "events": ["/"]},
+  {"referrer": "https://b.com/", "events": [0]},
+  {"referrer": "https://b.com/", "events": [3]}
+]`
+
+var testSessions = []Session{
+	{Referrer: "https://a.com/", Events: []interface{}{"/", 5, "/b"}},
+	{Referrer: "", Events: []interface{}{"/"}},
+	{Referrer: "https://b.com/", Events: []interface{}{0}},
+	{Referrer: "https://b.com/", Events: []interface{}{3}},
+}
+
+func TestDayStatsWithPoints(t *testing.T) {
+	var decoded []Session
+	if err := json.Unmarshal([]byte(testSessionsJSON), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoded[0].Events[1].(float64); !ok {
+		t.Fatalf("expected points decoded as float64, got %T", decoded[0].Events[1])
+	}
+
+	expected := Stats{
+		NSessions:  4,
+		NBounces:   2, // a single pageview and a single event with no points
+		NPageviews: 3,
+		Score:      11,
+	}
+	for name, sessions := range map[string][]Session{
+		"redis":    testSessions,
+		"postgres": decoded,
+	} {
+		if stats := (Day{sessions: sessions}).stats(); stats != expected {
+			t.Errorf("%s: stats() = %+v, expected %+v", name, stats, expected)
+		}
+	}
+}
+
+func TestCompendiumWithPoints(t *testing.T) {
+	var decoded []Session
+	if err := json.Unmarshal([]byte(testSessionsJSON), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedScores := map[string]int{"https://a.com/": 7, "": 1, "https://b.com/": 3}
+	expectedPages := map[string]int{"/": 2, "/b": 1}
+	for name, sessions := range map[string][]Session{
+		"redis":    testSessions,
+		"postgres": decoded,
+	} {
+		compendium := newCompendium()
+		for _, session := range sessions {
+			compendium.apply(session)
+		}
+		if !reflect.DeepEqual(compendium.TopReferrersScores, expectedScores) {
+			t.Errorf("%s: referrer scores = %v, expected %v", name, compendium.TopReferrersScores, expectedScores)
+		}
+		if !reflect.DeepEqual(compendium.TopPages, expectedPages) {
+			t.Errorf("%s: pages = %v, expected %v", name, compendium.TopPages, expectedPages)
+		}
+	}
+}
+
+func TestSessionScore(t *testing.T) {
+	var decoded []Session
+	if err := json.Unmarshal([]byte(testSessionsJSON), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []int{7, 1, 0, 3} {
+		if score := testSessions[i].score(); score != expected {
+			t.Errorf("session %d: score() = %d, expected %d", i, score, expected)
+		}
+		if score := decoded[i].score(); score != expected {
+			t.Errorf("decoded session %d: score() = %d, expected %d", i, score, expected)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import "strings"
+
+// parseUserAgent turns a User-Agent string into the broad categories we care
+// about. we don't try to be exhaustive here, anything that isn't recognized
+// becomes "Other".
+func parseUserAgent(useragent string) (device, browser, os string) {
+	ua := strings.ToLower(useragent)
+	return uaDevice(ua), uaBrowser(ua), uaOS(ua)
+}
+
+func uaDevice(ua string) string {
+	switch {
+	case strings.Contains(ua, "ipad"),
+		strings.Contains(ua, "tablet"),
+		strings.Contains(ua, "kindle"),
+		strings.Contains(ua, "silk/"),
+		strings.Contains(ua, "playbook"),
+		strings.Contains(ua, "android") && !strings.Contains(ua, "mobile"):
+		return "tablet"
+	case strings.Contains(ua, "mobi"),
+		strings.Contains(ua, "iphone"),
+		strings.Contains(ua, "ipod"),
+		strings.Contains(ua, "android"),
+		strings.Contains(ua, "windows phone"),
+		strings.Contains(ua, "blackberry"),
+		strings.Contains(ua, "opera mini"):
+		return "mobile"
+	default:
+		return "desktop"
+	}
+}
+
+func uaBrowser(ua string) string {
+	switch {
+	case strings.Contains(ua, "edg/"),
+		strings.Contains(ua, "edge/"),
+		strings.Contains(ua, "edga/"),
+		strings.Contains(ua, "edgios/"):
+		return "Edge"
+	case strings.Contains(ua, "opr/"), strings.Contains(ua, "opera"):
+		return "Opera"
+	case strings.Contains(ua, "samsungbrowser"):
+		return "Samsung Internet"
+	case strings.Contains(ua, "yabrowser"):
+		return "Yandex Browser"
+	case strings.Contains(ua, "vivaldi"):
+		return "Vivaldi"
+	case strings.Contains(ua, "ucbrowser"):
+		return "UC Browser"
+	case strings.Contains(ua, "firefox/"), strings.Contains(ua, "fxios/"):
+		return "Firefox"
+	case strings.Contains(ua, "crios/"),
+		strings.Contains(ua, "chrome/"),
+		strings.Contains(ua, "chromium/"):
+		return "Chrome"
+	case strings.Contains(ua, "safari/"):
+		return "Safari"
+	case strings.Contains(ua, "msie"), strings.Contains(ua, "trident/"):
+		return "Internet Explorer"
+	default:
+		return "Other"
+	}
+}
+
+func uaOS(ua string) string {
+	switch {
+	case strings.Contains(ua, "windows"):
+		return "Windows"
+	case strings.Contains(ua, "iphone"),
+		strings.Contains(ua, "ipad"),
+		strings.Contains(ua, "ipod"):
+		return "iOS"
+	case strings.Contains(ua, "mac os x"), strings.Contains(ua, "macintosh"):
+		return "macOS"
+	case strings.Contains(ua, "android"):
+		return "Android"
+	case strings.Contains(ua, "cros"):
+		return "Chrome OS"
+	case strings.Contains(ua, "linux"):
+		return "Linux"
+	case strings.Contains(ua, "bsd"):
+		return "BSD"
+	default:
+		return "Other"
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+)
+
+// to count unique visitors without cookies, each session gets a hash of the
+// visitor IP, User-Agent and the site, salted with a random value that changes
+// every day. the salt is kept only on redis and expires shortly after its day
+// ends, so the hashes can't be linked to an IP or to each other across days.
+func makeSaltKey(day string) string { return "salt:" + day }
+
+var visitorSalt struct {
+	sync.Mutex
+	day  string
+	salt string
+}
+
+// daySalt returns the salt for the day, creating it if needed. all server
+// instances share the same salt through redis.
+func daySalt(day string) (string, error) {
+	visitorSalt.Lock()
+	defer visitorSalt.Unlock()
+	if visitorSalt.day == day {
+		return visitorSalt.salt, nil
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	key := makeSaltKey(day)
+	if err := rds.SetNX(key, hex.EncodeToString(random), time.Hour*36).Err(); err != nil {
+		return "", err
+	}
+	salt, err := rds.Get(key).Result()
+	if err != nil {
+		return "", err
+	}
+
+	visitorSalt.day = day
+	visitorSalt.salt = salt
+	return salt, nil
+}
+
+// visitorID is the same for every session of a visitor on a site in a day.
+// 16 hex characters are more than enough to tell visitors apart.
+func visitorID(domain, day string, ip net.IP, useragent string) (string, error) {
+	salt, err := daySalt(day)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(salt + "\x00" + ip.String() + "\x00" + useragent + "\x00" + domain))
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// countVisitors counts the distinct visitors in the sessions of a single day.
+// sessions from before COUNT_VISITORS was enabled are not counted.
+func countVisitors(sessions []Session) int {
+	seen := make(map[string]bool)
+	for _, session := range sessions {
+		if session.Visitor != "" {
+			seen[session.Visitor] = true
+		}
+	}
+	return len(seen)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/lucsky/cuid"
+)
+
+func TestVisitorID(t *testing.T) {
+	testRedis(t)
+	day, otherDay := "20170101", "20170102"
+	rds.Del(makeSaltKey(day), makeSaltKey(otherDay))
+	defer rds.Del(makeSaltKey(day), makeSaltKey(otherDay))
+	visitorSalt.day = ""
+
+	ip := net.ParseIP("203.0.113.1")
+	ua := "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"
+	id := func(domain, day string, ip net.IP, ua string) string {
+		visitor, err := visitorID(domain, day, ip, ua)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return visitor
+	}
+
+	visitor := id("a.com", day, ip, ua)
+	if len(visitor) != 16 {
+		t.Errorf("visitor id %q should have 16 characters", visitor)
+	}
+	if again := id("a.com", day, ip, ua); again != visitor {
+		t.Errorf("same visitor got %q and %q on the same day", visitor, again)
+	}
+
+	// other server instances share the salt through redis
+	visitorSalt.day = ""
+	if again := id("a.com", day, ip, ua); again != visitor {
+		t.Errorf("same visitor got %q and %q after reloading the salt", visitor, again)
+	}
+
+	for name, other := range map[string]string{
+		"other site": id("b.com", day, ip, ua),
+		"other ip":   id("a.com", day, net.ParseIP("203.0.113.2"), ua),
+		"other ua":   id("a.com", day, ip, ua+" extra"),
+		"other day":  id("a.com", otherDay, ip, ua),
+	} {
+		if other == visitor {
+			t.Errorf("%s: got the same visitor id %q", name, visitor)
+		}
+	}
+
+	// the salt is random, so the ids can't be computed without it
+	rds.Del(makeSaltKey(day))
+	visitorSalt.day = ""
+	if again := id("a.com", day, ip, ua); again == visitor {
+		t.Error("a new salt should give a different visitor id")
+	}
+}
+
+func TestCountVisitors(t *testing.T) {
+	sessions := []Session{
+		{Visitor: "a"},
+		{Visitor: "b"},
+		{Visitor: "a"},
+		{}, // from before COUNT_VISITORS, or anonymous
+	}
+	if n := countVisitors(sessions); n != 2 {
+		t.Errorf("countVisitors() = %d, expected 2", n)
+	}
+	if n := (Day{sessions: sessions}).stats().NVisitors; n != 2 {
+		t.Errorf("stats().NVisitors = %d, expected 2", n)
+	}
+}
+
+// trackScript keeps the visitors of the day, so they can be counted without
+// reading every session.
+func TestVisitorsFromRedis(t *testing.T) {
+	testRedis(t)
+	domain := "visitors.invalid"
+	today := presentDay().Format(DATEFORMAT)
+	deleteDayFromRedis(domain, today)
+	defer deleteDayFromRedis(domain, today)
+
+	for _, visitor := range []string{"a", "b", "a", ""} {
+		h := hit{domain: domain, day: today, session: cuid.New(), newSession: true, event: "/"}
+		if visitor != "" {
+			h.attrs = map[string]string{"visitor": visitor}
+		}
+		if _, err := storeHit(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, _, err := statsFromRedis(domain, today)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NVisitors != 2 {
+		t.Errorf("NVisitors = %d, expected 2", stats.NVisitors)
+	}
+	if computed := dayFromRedis(domain, today).stats(); computed != stats {
+		t.Errorf("counters = %+v, but the sessions give %+v", stats, computed)
+	}
+}